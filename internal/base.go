@@ -1,15 +1,22 @@
 package internal
 
 import (
+	"context"
+	"fmt"
 	"github.com/HEUDavid/go-fsm/pkg/db"
 	. "github.com/HEUDavid/go-fsm/pkg/metadata"
 	"github.com/HEUDavid/go-fsm/pkg/mq"
 	"github.com/HEUDavid/go-fsm/pkg/util"
+	"gorm.io/gorm"
 	"gorm.io/gorm/schema"
+	"time"
 )
 
 type IBase[Data DataEntity] interface {
 	RegisterModel(dataModel DataEntity, taskModel, uniqueRequestModel schema.Tabler)
+	RegisterFlowModel(taskFlowModel, dataFlowModel schema.Tabler)
+	RegisterDeadLetterModel(deadLetterModel schema.Tabler)
+	RegisterOutboxModel(outboxModel schema.Tabler)
 	RegisterDB(db db.IDB)
 	RegisterMQ(mq mq.IMQ)
 	RegisterFSM(fsm FSM[Data])
@@ -22,8 +29,9 @@ type Base[Data DataEntity] struct {
 	db.IDB
 	mq.IMQ
 	FSM[Data]
-	GenID func() string // ID Generator
-	DEBUG bool
+	GenID      func() string // ID Generator
+	Propagator mq.Propagator // Optional, carries the trace context in the message envelope
+	DEBUG      bool
 }
 
 func (b *Base[Data]) RegisterModel(dataModel DataEntity, taskModel, uniqueRequestModel schema.Tabler) {
@@ -44,6 +52,41 @@ func (b *Base[Data]) RegisterModel(dataModel DataEntity, taskModel, uniqueReques
 	b.UniqueRequestModel = uniqueRequestModel
 }
 
+// RegisterFlowModel Optional, keeps the history of every create and transition
+func (b *Base[Data]) RegisterFlowModel(taskFlowModel, dataFlowModel schema.Tabler) {
+	if !(taskFlowModel != nil && dataFlowModel != nil) {
+		panic("[FSM] Model task_flow、data_flow should not be nil")
+	}
+	if !(util.HasAttr(taskFlowModel, "TaskID") && util.HasAttr(taskFlowModel, "ToState") && util.HasAttr(taskFlowModel, "Version")) {
+		panic("[FSM] Model task_flow error")
+	}
+	b.TaskFlowModel = taskFlowModel
+	b.DataFlowModel = dataFlowModel
+}
+
+// RegisterDeadLetterModel Optional, records the last error of tasks whose retries are exhausted
+func (b *Base[Data]) RegisterDeadLetterModel(deadLetterModel schema.Tabler) {
+	if deadLetterModel == nil {
+		panic("[FSM] Model dead_letter should not be nil")
+	}
+	if !(util.HasAttr(deadLetterModel, "TaskID") && util.HasAttr(deadLetterModel, "LastError")) {
+		panic("[FSM] Model dead_letter error")
+	}
+	b.DeadLetterModel = deadLetterModel
+}
+
+// RegisterOutboxModel Optional, task messages are written to the outbox within the task transaction,
+// and published by the Relay instead of right after the commit.
+func (b *Base[Data]) RegisterOutboxModel(outboxModel schema.Tabler) {
+	if outboxModel == nil {
+		panic("[FSM] Model outbox should not be nil")
+	}
+	if !(util.HasAttr(outboxModel, "Body") && util.HasAttr(outboxModel, "Sent")) {
+		panic("[FSM] Model outbox error")
+	}
+	b.OutboxModel = outboxModel
+}
+
 func (b *Base[Data]) RegisterDB(db db.IDB) {
 	b.IDB = db
 }
@@ -59,3 +102,52 @@ func (b *Base[Data]) RegisterFSM(fsm FSM[Data]) {
 func (b *Base[Data]) RegisterGenerator(genID func() string) {
 	b.GenID = genID
 }
+
+// PublishedInTx Whether the task message is written within the task transaction, by the outbox or an ITxMQ,
+// then it should not be published again after the commit.
+func (b *Base[Data]) PublishedInTx() bool {
+	_, ok := b.IMQ.(mq.ITxMQ)
+	return b.OutboxModel != nil || ok
+}
+
+// CheckTxPublish The outbox and an ITxMQ both write the task message within the task transaction,
+// registering both would enqueue every message twice.
+func (b *Base[Data]) CheckTxPublish() error {
+	if _, ok := b.IMQ.(mq.ITxMQ); ok && b.OutboxModel != nil {
+		return fmt.Errorf("outbox not needed with %T, which publishes within the task transaction", b.IMQ)
+	}
+	return nil
+}
+
+// TxHooks Writes the task message within the task transaction, to the MQ if it is an ITxMQ, or else to the outbox
+func (b *Base[Data]) TxHooks() []TxHook[Data] {
+	if txMQ, ok := b.IMQ.(mq.ITxMQ); ok {
+		return []TxHook[Data]{func(c context.Context, tx *gorm.DB, task *Task[Data]) error {
+			return txMQ.PublishMessageTx(c, tx, b.GenMessage(c, task))
+		}}
+	}
+	if b.OutboxModel != nil {
+		return []TxHook[Data]{func(c context.Context, tx *gorm.DB, task *Task[Data]) error {
+			return AddOutbox(c, tx, b.Models, task.ID, b.GenMessage(c, task))
+		}}
+	}
+	return nil
+}
+
+// GenMessage Encodes the envelope of the task, the trace context of c is injected if Propagator is set
+func (b *Base[Data]) GenMessage(c context.Context, task *Task[Data]) string {
+	envelope := &mq.Envelope{
+		TaskID:      task.ID,
+		FSM:         b.FSM.Name,
+		Type:        task.Type,
+		State:       task.State,
+		Version:     task.Version,
+		Attempt:     task.Attempt,
+		EnqueueTime: time.Now(),
+	}
+	if b.Propagator != nil {
+		envelope.Headers = map[string]string{}
+		b.Propagator.Inject(c, envelope.Headers)
+	}
+	return envelope.Encode()
+}
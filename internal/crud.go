@@ -5,17 +5,130 @@ import (
 	"fmt"
 	. "github.com/HEUDavid/go-fsm/pkg/metadata"
 	"github.com/HEUDavid/go-fsm/pkg/util"
-	"github.com/go-sql-driver/mysql"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
 )
 
-func addTaskFlow[Data DataEntity](c Context, tx *gorm.DB, m Models, task *Task[Data], queryFirst bool) error {
+var schemaCache = &sync.Map{}
+
+// dataColumns returns the columns of the Data table, its own primary key is excluded
+func dataColumns(tx *gorm.DB, m Models) ([]string, error) {
+	s, err := schema.Parse(m.DataModel, schemaCache, tx.NamingStrategy)
+	if err != nil {
+		return nil, err
+	}
+	var columns []string
+	for _, field := range s.Fields {
+		if field.DBName == "" || (field.PrimaryKey && field.DBName != "task_id") {
+			continue
+		}
+		columns = append(columns, field.DBName)
+	}
+	return columns, nil
+}
+
+// addTaskFlow appends a TaskFlow row and a snapshot of the Data row, from is nil when the task is created
+func addTaskFlow[Data DataEntity](c Context, tx *gorm.DB, m Models, task *Task[Data], from *Task[Data]) error {
 	if m.TaskFlowModel == nil || m.DataFlowModel == nil {
 		return nil
 	}
+
+	values := map[string]interface{}{
+		"task_id":    task.ID,
+		"request_id": task.RequestID,
+		"type":       task.Type,
+		"from_state": "",
+		"to_state":   task.State,
+		"version":    task.Version,
+	}
+	if from != nil {
+		values["type"] = from.Type
+		values["from_state"] = from.State
+	}
+	taskFlow, err := newTaskFlow(c, tx, m, values)
+	if err != nil {
+		return err
+	}
+	if err = tx.Table(m.TaskFlowModel.TableName()).Create(taskFlow).Error; err != nil {
+		return err
+	}
+
+	columns, err := dataColumns(tx, m)
+	if err != nil {
+		return err
+	}
+	dataFlow := map[string]interface{}{}
+	if err = tx.Table(m.DataModel.TableName()).Select(columns).Where("task_id = ?", task.ID).Take(&dataFlow).Error; err != nil {
+		return err
+	}
+	dataFlow["version"] = task.Version
+	if err = tx.Table(m.DataFlowModel.TableName()).Create(dataFlow).Error; err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// newTaskFlow returns a row of the registered TaskFlowModel, so its own columns and hooks apply.
+// The values of columns the model does not have are skipped.
+func newTaskFlow(c Context, tx *gorm.DB, m Models, values map[string]interface{}) (interface{}, error) {
+	s, err := schema.Parse(m.TaskFlowModel, schemaCache, tx.NamingStrategy)
+	if err != nil {
+		return nil, err
+	}
+	taskFlow := util.ReflectNew(m.TaskFlowModel)
+	rv := reflect.Indirect(reflect.ValueOf(taskFlow))
+	for column, value := range values {
+		if field := s.LookUpField(column); field != nil {
+			if err = field.Set(c, rv, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return taskFlow, nil
+}
+
+// AddOutbox Writes the message of the task to the outbox, called within the task transaction
+func AddOutbox(c Context, tx *gorm.DB, m Models, taskID, body string) error {
+	return tx.Table(m.OutboxModel.TableName()).Create(&Outbox{TaskID: taskID, Body: body}).Error
+}
+
+// RelayOutbox Publishes the unsent outbox messages in order and marks them sent.
+// publish is called within the transaction holding the row locks, so concurrent relays skip the rows being published,
+// and a slow MQ keeps the transaction open and the batch locked meanwhile. publish should not write to the DB.
+// A crash after publishing and before the commit publishes the batch again.
+func RelayOutbox(c Context, db *gorm.DB, m Models, limit int, publish func(body string) error) (int, error) {
+	var ids []uint64
+	var publishErr error
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		var messages []Outbox
+		if e := tx.Table(m.OutboxModel.TableName()).Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("sent = ?", false).Order("id").Limit(limit).Find(&messages).Error; e != nil {
+			return e
+		}
+
+		for _, msg := range messages {
+			if publishErr = publish(msg.Body); publishErr != nil {
+				break
+			}
+			ids = append(ids, msg.ID)
+		}
+		if len(ids) <= 0 {
+			return nil
+		}
+		return tx.Table(m.OutboxModel.TableName()).Where("id in ?", ids).
+			Updates(map[string]interface{}{"sent": true, "send_time": time.Now()}).Error
+	}); err != nil {
+		return 0, err
+	}
+	return len(ids), publishErr
+}
+
 func addUnique[Data DataEntity](c Context, tx *gorm.DB, m Models, task *Task[Data], needModifyTaskID bool) (bool, error) {
 	uniqueReq := struct {
 		RequestID string
@@ -25,38 +138,79 @@ func addUnique[Data DataEntity](c Context, tx *gorm.DB, m Models, task *Task[Dat
 		task.ID,
 	}
 
-	err := tx.Table(m.UniqueRequestModel.TableName()).Create(&uniqueReq).Error
-	if err == nil {
+	// A failed INSERT aborts the whole transaction on PostgreSQL, so a duplicate request is told by no row inserted
+	result := tx.Table(m.UniqueRequestModel.TableName()).Clauses(clause.OnConflict{DoNothing: true}).Create(&uniqueReq)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected > 0 {
 		return false, nil
 	}
 
-	mysqlErr, ok := err.(*mysql.MySQLError)
-	if !ok {
-		return false, fmt.Errorf("assert MySQLError: %w", mysqlErr)
+	if needModifyTaskID { // Use the TaskID recorded in the DB to assign values, making the interface idempotent.
+		if err := tx.Table(m.UniqueRequestModel.TableName()).Where("request_id = ?", task.RequestID).Scan(&uniqueReq).Error; err != nil {
+			return true, err
+		}
+		task.SetTaskID(uniqueReq.TaskID)
+	}
+	return true, nil
+}
+
+// TxHook runs within the task transaction after the task is written, e.g. enqueueing into a queue in the same database
+type TxHook[Data DataEntity] func(c Context, tx *gorm.DB, task *Task[Data]) error
+
+func runTxHooks[Data DataEntity](c Context, tx *gorm.DB, task *Task[Data], hooks []TxHook[Data]) error {
+	for _, hook := range hooks {
+		if err := hook(c, tx, task); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runCallbacks runs OnExit of the previous state, OnTransition and OnEnter of the next state,
+// a transition from a state to itself only runs OnTransition.
+func runCallbacks[Data DataEntity](c Context, tx *gorm.DB, task *Task[Data], fsm FSM[Data], transition Transition[Data]) error {
+	from, to := transition.From.GetName(), transition.To.GetName()
+	if state, _ := fsm.GetState(from); from != to && state.OnExit != nil {
+		if err := state.OnExit(c, tx, task); err != nil {
+			return &CallbackError{Callback: "on exit " + from, Err: err}
+		}
 	}
+	if transition.OnTransition != nil {
+		if err := transition.OnTransition(c, tx, task); err != nil {
+			return &CallbackError{Callback: "on transition " + transition.GetName(), Err: err}
+		}
+	}
+	if state, _ := fsm.GetState(to); from != to && state.OnEnter != nil {
+		if err := state.OnEnter(c, tx, task); err != nil {
+			return &CallbackError{Callback: "on enter " + to, Err: err}
+		}
+	}
+	return nil
+}
 
-	switch mysqlErr.Number {
-	case 1062:
-		if needModifyTaskID { // Use the TaskID recorded in the DB to assign values, making the interface idempotent.
-			if err = tx.Table(m.UniqueRequestModel.TableName()).Where("request_id = ?", task.RequestID).Scan(&uniqueReq).Error; err != nil {
-				return true, err
+// OnEnterHook runs OnEnter of the state a task is created in
+func OnEnterHook[Data DataEntity](fsm FSM[Data]) TxHook[Data] {
+	return func(c Context, tx *gorm.DB, task *Task[Data]) error {
+		if state, _ := fsm.GetState(task.State); state.OnEnter != nil {
+			if err := state.OnEnter(c, tx, task); err != nil {
+				return &CallbackError{Callback: "on enter " + task.State, Err: err}
 			}
-			task.SetTaskID(uniqueReq.TaskID)
 		}
-		return true, nil
+		return nil
 	}
-	return false, err
 }
 
-func CreateTask[Data DataEntity](c Context, m Models, task *Task[Data]) error {
+func CreateTask[Data DataEntity](c Context, m Models, task *Task[Data], hooks ...TxHook[Data]) error {
 	db := task.WithDB
-	if err := db.Transaction(func(tx *gorm.DB) error { return _createTask(c, tx, m, task) }); err != nil {
+	if err := db.Transaction(func(tx *gorm.DB) error { return _createTask(c, tx, m, task, hooks) }); err != nil {
 		return err
 	}
 	return nil
 }
 
-func _createTask[Data DataEntity](c Context, tx *gorm.DB, m Models, task *Task[Data]) error {
+func _createTask[Data DataEntity](c Context, tx *gorm.DB, m Models, task *Task[Data], hooks []TxHook[Data]) error {
 	keyConflict, e := addUnique(c, tx, m, task, true)
 	if e != nil {
 		return e
@@ -72,7 +226,10 @@ func _createTask[Data DataEntity](c Context, tx *gorm.DB, m Models, task *Task[D
 		return e
 	}
 
-	if e = addTaskFlow(c, tx, m, task, false); e != nil {
+	if e = addTaskFlow(c, tx, m, task, nil); e != nil {
+		return e
+	}
+	if e = runTxHooks(c, tx, task, hooks); e != nil {
 		return e
 	}
 
@@ -112,20 +269,140 @@ func QueryTaskState(c Context, db *gorm.DB, m Models, taskID string) (*string, e
 	return &state, nil
 }
 
-func UpdateTask[Data DataEntity](c Context, m Models, task *Task[Data], fsm FSM[Data]) error {
+// QueryDataByVersion loads the Data snapshot of the task as of the given version
+func QueryDataByVersion[Data DataEntity](c Context, db *gorm.DB, m Models, taskID string, version uint) (Data, error) {
+	data, _ := util.Assert[Data](util.ReflectNew(m.DataModel))
+	if m.TaskFlowModel == nil || m.DataFlowModel == nil {
+		return data, fmt.Errorf("task flow not registered")
+	}
+
+	columns, err := dataColumns(db, m)
+	if err != nil {
+		return data, err
+	}
+	if err = db.Table(m.DataFlowModel.TableName()).Select(columns).Where("task_id = ? and version = ?", taskID, version).Take(data).Error; err != nil {
+		return data, err
+	}
+	return data, nil
+}
+
+// QueryStateTime returns when the task entered the state it has at the version, nil if task flows are not kept
+func QueryStateTime(c Context, db *gorm.DB, m Models, taskID, state string, version uint) (*time.Time, error) {
+	if m.TaskFlowModel == nil {
+		return nil, nil
+	}
+	var flow TaskFlow
+	if err := db.Table(m.TaskFlowModel.TableName()).Select("create_time").
+		Where("task_id = ? and to_state = ? and from_state <> ? and version <= ?", taskID, state, state, version).
+		Order("version desc").Take(&flow).Error; err != nil {
+		return nil, err
+	}
+	return &flow.CreateTime, nil
+}
+
+// QueryTaskHistory loads all transitions of the task ordered by version
+func QueryTaskHistory[Data DataEntity](c Context, db *gorm.DB, m Models, taskID string) ([]*TaskHistory[Data], error) {
+	if m.TaskFlowModel == nil || m.DataFlowModel == nil {
+		return nil, fmt.Errorf("task flow not registered")
+	}
+
+	var flows []TaskFlow
+	if err := db.Table(m.TaskFlowModel.TableName()).Where("task_id = ?", taskID).Order("version").Find(&flows).Error; err != nil {
+		return nil, err
+	}
+
+	if len(flows) == 0 {
+		return []*TaskHistory[Data]{}, nil
+	}
+
+	// One snapshot is written with every flow, in the same transaction, so both sorted by version pair up
+	versions := make([]uint, len(flows))
+	for i, flow := range flows {
+		versions[i] = flow.Version
+	}
+	columns, err := dataColumns(db, m)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []Data
+	if err = db.Table(m.DataFlowModel.TableName()).Select(columns).Where("task_id = ? and version in ?", taskID, versions).
+		Order("version").Find(&snapshots).Error; err != nil {
+		return nil, err
+	}
+	if len(snapshots) != len(flows) {
+		return nil, fmt.Errorf("task %s has %d flows but %d data snapshots", taskID, len(flows), len(snapshots))
+	}
+
+	history := make([]*TaskHistory[Data], len(flows))
+	for i, flow := range flows {
+		history[i] = &TaskHistory[Data]{TaskFlow: flow, Data: snapshots[i]}
+	}
+	return history, nil
+}
+
+// IncrTaskAttempt Counts a failed attempt of the current state, false if the task has moved on
+func IncrTaskAttempt(c Context, db *gorm.DB, m Models, taskID string, version uint) (bool, error) {
+	result := db.Table(m.TaskModel.TableName()).Where("id = ? and version = ?", taskID, version).Updates(map[string]interface{}{
+		"attempt":     gorm.Expr("attempt + 1"),
+		"update_time": time.Now(),
+	})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// ClaimStuckTasks Claims tasks staying in the state since before, by touching their update_time.
+// Only one of the concurrent claimers succeeds for a task, so it is re-driven once per threshold.
+func ClaimStuckTasks(c Context, db *gorm.DB, m Models, state string, before time.Time, limit int) ([]string, error) {
+	var tasks []struct {
+		ID      string
+		Version uint
+	}
+	q := db.Table(m.TaskModel.TableName()).Select("id", "version").Where("state = ? and update_time < ?", state, before)
+	if m.DeadLetterModel != nil { // Tasks only recorded as dead letter stay in their state
+		q = q.Where(fmt.Sprintf("not exists (select 1 from %s d where d.task_id = %s.id and d.version = %s.version)",
+			m.DeadLetterModel.TableName(), m.TaskModel.TableName(), m.TaskModel.TableName()))
+	}
+	if err := q.Limit(limit).Find(&tasks).Error; err != nil {
+		return nil, err
+	}
+
+	var claimed []string
+	for _, task := range tasks {
+		result := db.Table(m.TaskModel.TableName()).
+			Where("id = ? and version = ? and update_time < ?", task.ID, task.Version, before).
+			Update("update_time", time.Now())
+		if result.Error != nil {
+			return claimed, result.Error
+		}
+		if result.RowsAffected > 0 {
+			claimed = append(claimed, task.ID)
+		}
+	}
+	return claimed, nil
+}
+
+func UpdateTask[Data DataEntity](c Context, m Models, task *Task[Data], fsm FSM[Data], hooks ...TxHook[Data]) error {
 	db := task.WithDB
-	if err := db.Transaction(func(tx *gorm.DB) error { return _updateTask(c, tx, m, task, fsm) }); err != nil {
+	if err := db.Transaction(func(tx *gorm.DB) error { return _updateTask(c, tx, m, task, fsm, hooks) }); err != nil {
 		return err
 	}
 	return nil
 }
 
-func _updateTask[Data DataEntity](c Context, tx *gorm.DB, m Models, task *Task[Data], fsm FSM[Data]) error {
+func _updateTask[Data DataEntity](c Context, tx *gorm.DB, m Models, task *Task[Data], fsm FSM[Data], hooks []TxHook[Data]) error {
 	keyConflict, e := addUnique(c, tx, m, task, false)
 	if e != nil {
 		return e
 	}
-	if keyConflict {
+	if keyConflict { // Replayed request, the task is as of now so that the message published again is not stale
+		var currentTask Task[Data]
+		currentTask.ID = task.ID
+		if e = tx.Table(m.TaskModel.TableName()).First(&currentTask).Error; e != nil {
+			return e
+		}
+		task.State, task.Version, task.Attempt = currentTask.State, currentTask.Version, currentTask.Attempt
 		return nil
 	}
 
@@ -138,11 +415,21 @@ func _updateTask[Data DataEntity](c Context, tx *gorm.DB, m Models, task *Task[D
 		return fmt.Errorf("task.Version not match: %d, %d", currentTask.Version, task.Version)
 	}
 	task.Version = currentTask.Version + 1
+	task.UpdateTime = time.Now()
 
-	_, exist := fsm.GetTransition(currentTask.State, task.State)
+	transition, exist := fsm.GetTransition(currentTask.State, task.State)
 	if !exist {
 		return fmt.Errorf("cannot transition, %s->%s", currentTask.State, task.State)
 	}
+	if len(transition.Guards) > 0 {
+		currentTask.Data, _ = util.Assert[Data](util.ReflectNew(m.DataModel))
+		if e = tx.Table(m.DataModel.TableName()).Where("task_id = ?", task.ID).Find(currentTask.GetData()).Error; e != nil {
+			return e
+		}
+		if e = transition.CheckGuards(c, &currentTask, task); e != nil {
+			return e
+		}
+	}
 
 	result := tx.Table(m.TaskModel.TableName()).Omit("request_id").Where("id = ? and version = ?", task.ID, currentTask.Version).Updates(task)
 	if result.Error != nil {
@@ -152,17 +439,74 @@ func _updateTask[Data DataEntity](c Context, tx *gorm.DB, m Models, task *Task[D
 		return nil
 	}
 
+	if currentTask.Attempt > 0 { // The retry budget is per state
+		if e = tx.Table(m.TaskModel.TableName()).Where("id = ?", task.ID).Update("attempt", 0).Error; e != nil {
+			return e
+		}
+		task.Attempt = 0
+	}
+
 	if e = updateData(c, tx, m, task); e != nil {
 		return e
 	}
+	if e = runCallbacks(c, tx, task, fsm, transition); e != nil {
+		return e
+	}
 
-	if e = addTaskFlow(c, tx, m, task, true); e != nil {
+	if e = addTaskFlow(c, tx, m, task, &currentTask); e != nil {
+		return e
+	}
+	if e = runTxHooks(c, tx, task, hooks); e != nil {
 		return e
 	}
 
 	return nil
 }
 
+// DeadLetterTask Moves the task into the dead letter state if toDeadLetter, and records the letter if DeadLetterModel is set
+func DeadLetterTask[Data DataEntity](c Context, m Models, task *Task[Data], fsm FSM[Data], toDeadLetter bool, letter *DeadLetter) error {
+	db := task.WithDB
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if toDeadLetter {
+			if e := _updateTask(c, tx, m, task, fsm, nil); e != nil {
+				return e
+			}
+		}
+		if m.DeadLetterModel != nil {
+			if e := tx.Table(m.DeadLetterModel.TableName()).Create(letter).Error; e != nil {
+				return e
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// nonZeroColumns returns the non-zero columns of data except the primary key and omitColumns
+func nonZeroColumns(c Context, tx *gorm.DB, m Models, data any, omitColumns []string) ([]string, error) {
+	s, err := schema.Parse(m.DataModel, schemaCache, tx.NamingStrategy)
+	if err != nil {
+		return nil, err
+	}
+	rv := reflect.Indirect(reflect.ValueOf(data))
+	for rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+
+	var columns []string
+	for _, field := range s.Fields {
+		if field.DBName == "" || (field.PrimaryKey && field.DBName != "task_id") || slices.Contains(omitColumns, field.DBName) {
+			continue
+		}
+		if _, isZero := field.ValueOf(c, rv); !isZero {
+			columns = append(columns, field.DBName)
+		}
+	}
+	return columns, nil
+}
+
 func updateData[Data DataEntity](c Context, tx *gorm.DB, m Models, task *Task[Data]) error {
 	_query := func(_tx *gorm.DB) *gorm.DB {
 		return _tx.Table(m.DataModel.TableName()).Where("task_id = ?", task.ID)
@@ -175,19 +519,19 @@ func updateData[Data DataEntity](c Context, tx *gorm.DB, m Models, task *Task[Da
 		return nil
 	}
 
-	sqlStr1 := tx.ToSQL(func(tx *gorm.DB) *gorm.DB {
-		return _query(tx).Omit(task.OmitColumns...).Updates(task.GetData())
-	})
-	sqlStr2 := tx.ToSQL(func(tx *gorm.DB) *gorm.DB {
-		return _query(tx).Select(task.SelectColumns).Updates(task.GetData())
-	})
-
-	sql, err := util.MergeUpdateSQL(sqlStr1, sqlStr2)
+	// One UPDATE of the non-zero columns (except OmitColumns) and the SelectColumns (even if zero-valued),
+	// built by gorm so that it works on every dialect.
+	columns, err := nonZeroColumns(c, tx, m, task.GetData(), task.OmitColumns)
 	if err != nil {
 		return err
 	}
+	for _, column := range task.SelectColumns {
+		if !slices.Contains(columns, column) {
+			columns = append(columns, column)
+		}
+	}
 
-	if err = tx.Exec(sql).Error; err != nil {
+	if err = _query(tx).Select(columns).Updates(task.GetData()).Error; err != nil {
 		return err
 	}
 
@@ -0,0 +1,307 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/HEUDavid/go-fsm/pkg/db/sqlite"
+	. "github.com/HEUDavid/go-fsm/pkg/metadata"
+	"github.com/HEUDavid/go-fsm/pkg/mq/dbq"
+	"github.com/HEUDavid/go-fsm/pkg/util"
+	"gorm.io/gorm"
+)
+
+type testData struct {
+	TaskID  string `gorm:"primaryKey;column:task_id;type:char(32)"`
+	Comment string `gorm:"column:comment"`
+	Amount  int    `gorm:"column:amount"`
+}
+
+func (d *testData) TableName() string       { return "data" }
+func (d *testData) SetTaskID(taskID string) { d.TaskID = taskID }
+
+type testTask struct{ Task[*testData] }
+
+func (t *testTask) TableName() string { return "task" }
+
+type testUniqueRequest struct {
+	RequestID string `gorm:"primaryKey;column:request_id;type:char(32)"`
+	TaskID    string `gorm:"column:task_id;type:char(32)"`
+}
+
+func (u *testUniqueRequest) TableName() string { return "unique_request" }
+
+type testTaskFlow struct {
+	TaskFlow
+	Operator string `gorm:"column:operator"`
+}
+
+func (f *testTaskFlow) TableName() string { return "task_flow" }
+
+func (f *testTaskFlow) BeforeCreate(tx *gorm.DB) error {
+	f.Operator = "fsm"
+	return nil
+}
+
+type testDataFlow struct {
+	ID      uint64 `gorm:"primaryKey;autoIncrement"`
+	TaskID  string `gorm:"column:task_id"`
+	Comment string `gorm:"column:comment"`
+	Amount  int    `gorm:"column:amount"`
+	Version uint   `gorm:"column:version"`
+}
+
+func (f *testDataFlow) TableName() string { return "data_flow" }
+
+var (
+	stateNew = GenState[*testData]("New", false, nil)
+	statePay = GenState[*testData]("Pay", false, nil)
+	stateEnd = GenState[*testData]("End", true, nil)
+	testFSM  = func() FSM[*testData] {
+		fsm := GenFSM[*testData]("TestFSM")
+		fsm.RegisterState(stateNew, statePay, stateEnd)
+		fsm.RegisterTransition(GenTransition(stateNew, statePay), GenTransition(statePay, stateEnd))
+		return fsm
+	}()
+)
+
+func setup(t *testing.T) (*gorm.DB, Models) {
+	factory := &sqlite.Factory{}
+	if err := factory.InitDB(util.Config{"path": ":memory:"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = factory.CloseDB() })
+
+	m := Models{
+		DataModel:          &testData{},
+		TaskModel:          &testTask{},
+		UniqueRequestModel: &testUniqueRequest{},
+		TaskFlowModel:      &testTaskFlow{},
+		DataFlowModel:      &testDataFlow{},
+	}
+	db := factory.GetDB()
+	if err := db.AutoMigrate(m.DataModel, m.TaskModel, m.UniqueRequestModel, m.TaskFlowModel, m.DataFlowModel); err != nil {
+		t.Fatal(err)
+	}
+	return db, m
+}
+
+func createTask(t *testing.T, db *gorm.DB, m Models, requestID, taskID string) *Task[*testData] {
+	task := GenTaskInstance(requestID, taskID, &testData{Comment: "created", Amount: 100})
+	task.Type = "test"
+	task.State = stateNew.GetName()
+	task.Version = 1
+	task.WithDB = db
+	if err := CreateTask(context.Background(), m, task); err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
+
+func TestCreateAndUpdateTask(t *testing.T) {
+	c := context.Background()
+	db, m := setup(t)
+
+	task := createTask(t, db, m, "request1", "task1")
+	if again := createTask(t, db, m, "request1", "task2"); again.ID != "task1" {
+		t.Errorf("create should be idempotent, got task %s", again.ID)
+	}
+
+	task.RequestID = "request2"
+	task.State = statePay.GetName()
+	task.Data = &testData{Comment: "paying"}
+	task.SetTaskID(task.ID)
+	task.SetSelectColumns([]string{"amount"}) // Update amount to zero
+	if err := UpdateTask(c, m, task, testFSM); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateTask(c, m, task, testFSM); err != nil { // Replayed request
+		t.Fatalf("update should be idempotent: %v", err)
+	}
+
+	loaded := GenTaskInstance("", "task1", &testData{})
+	loaded.WithDB = db
+	if err := QueryTask(c, m, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.State != "Pay" || loaded.Version != 2 || loaded.Data.Comment != "paying" || loaded.Data.Amount != 0 {
+		t.Errorf("unexpected task: %s", util.Pretty(loaded))
+	}
+
+	loaded.RequestID = "request3"
+	loaded.State = stateNew.GetName()
+	if err := UpdateTask(c, m, loaded, testFSM); err == nil {
+		t.Error("Pay->New should not be allowed")
+	}
+}
+
+func TestAddTaskFlow(t *testing.T) {
+	c := context.Background()
+	db, m := setup(t)
+
+	task := createTask(t, db, m, "request1", "task1")
+	task.RequestID = "request2"
+	task.State = statePay.GetName()
+	task.Data.Amount = 200
+	if err := UpdateTask(c, m, task, testFSM); err != nil {
+		t.Fatal(err)
+	}
+
+	var flows []testTaskFlow
+	if err := db.Table("task_flow").Where("task_id = ?", "task1").Order("version").Find(&flows).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 2 {
+		t.Fatalf("expected 2 flows, got %d", len(flows))
+	}
+	for i, expected := range []struct {
+		from, to, requestID string
+	}{{"", "New", "request1"}, {"New", "Pay", "request2"}} {
+		f := flows[i]
+		if f.FromState != expected.from || f.ToState != expected.to || f.RequestID != expected.requestID ||
+			f.Version != uint(i+1) || f.Operator != "fsm" { // Written through the registered model
+			t.Errorf("unexpected flow: %s", util.Pretty(f))
+		}
+	}
+
+	var amounts []int
+	if err := db.Table("data_flow").Where("task_id = ?", "task1").Order("version").Pluck("amount", &amounts).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(amounts) != 2 || amounts[0] != 100 || amounts[1] != 200 {
+		t.Errorf("unexpected data snapshots: %v", amounts)
+	}
+}
+
+func TestQueryTaskHistory(t *testing.T) {
+	c := context.Background()
+	db, m := setup(t)
+
+	task := createTask(t, db, m, "request1", "task1")
+	task.RequestID = "request2"
+	task.State = statePay.GetName()
+	task.Data.Comment = "paying"
+	if err := UpdateTask(c, m, task, testFSM); err != nil {
+		t.Fatal(err)
+	}
+
+	var queries int
+	if err := db.Callback().Query().After("gorm:query").Register("count", func(*gorm.DB) { queries++ }); err != nil {
+		t.Fatal(err)
+	}
+	history, err := QueryTaskHistory[*testData](c, db, m, "task1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || queries != 2 { // The flows, then the snapshots of all versions
+		t.Fatalf("expected 2 flows in 2 queries, got %d in %d", len(history), queries)
+	}
+	if h := history[0]; h.FromState != "" || h.ToState != "New" || h.Version != 1 || h.RequestID != "request1" || h.Data.Comment != "created" {
+		t.Errorf("unexpected flow: %s", util.Pretty(h))
+	}
+	if h := history[1]; h.FromState != "New" || h.ToState != "Pay" || h.Version != 2 || h.Type != "test" || h.Data.Comment != "paying" {
+		t.Errorf("unexpected flow: %s", util.Pretty(h))
+	}
+
+	data, err := QueryDataByVersion[*testData](c, db, m, "task1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.TaskID != "task1" || data.Comment != "created" || data.Amount != 100 {
+		t.Errorf("unexpected data: %s", util.Pretty(data))
+	}
+}
+
+func TestClaimStuckTasks(t *testing.T) {
+	c := context.Background()
+	db, m := setup(t)
+
+	createTask(t, db, m, "request1", "task1")
+	if err := db.Table("task").Where("id = ?", "task1").Update("update_time", time.Now().Add(-time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now().Add(-time.Minute)
+	claimed, err := ClaimStuckTasks(c, db, m, "New", before, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 1 || claimed[0] != "task1" {
+		t.Errorf("unexpected claimed: %v", claimed)
+	}
+	if claimed, _ = ClaimStuckTasks(c, db, m, "New", before, 10); len(claimed) != 0 {
+		t.Errorf("task should be claimed once, got %v", claimed)
+	}
+}
+
+type testOutbox struct{ Outbox }
+
+func (o *testOutbox) TableName() string { return "outbox" }
+
+func TestRelayOutbox(t *testing.T) {
+	c := context.Background()
+	db, m := setup(t)
+	m.OutboxModel = &testOutbox{}
+	if err := db.AutoMigrate(m.OutboxModel); err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"a", "b", "c"} {
+		if err := AddOutbox(c, db, m, "task1", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var published []string
+	relay := func(limit int, fail string) (int, error) {
+		return RelayOutbox(c, db, m, limit, func(body string) error {
+			if body == fail {
+				return fmt.Errorf("publish %s failed", body)
+			}
+			published = append(published, body)
+			return nil
+		})
+	}
+	unsent := func() (bodies []string) {
+		if err := db.Table("outbox").Where("sent = ?", false).Order("id").Pluck("body", &bodies).Error; err != nil {
+			t.Fatal(err)
+		}
+		return bodies
+	}
+
+	if n, err := relay(2, "b"); n != 1 || err == nil { // a is sent, b stays for the next relay
+		t.Errorf("unexpected relay: %d, %v", n, err)
+	}
+	if bodies := unsent(); !slices.Equal(bodies, []string{"b", "c"}) {
+		t.Errorf("unexpected unsent messages: %v", bodies)
+	}
+	if n, err := relay(1, ""); n != 1 || err != nil { // Limited to b
+		t.Errorf("unexpected relay: %d, %v", n, err)
+	}
+	if n, err := relay(10, ""); n != 1 || err != nil {
+		t.Errorf("unexpected relay: %d, %v", n, err)
+	}
+	if n, err := relay(10, ""); n != 0 || err != nil {
+		t.Errorf("unexpected relay: %d, %v", n, err)
+	}
+	if !slices.Equal(published, []string{"a", "b", "c"}) || len(unsent()) != 0 {
+		t.Errorf("unexpected published messages: %v", published)
+	}
+}
+
+func TestCheckTxPublish(t *testing.T) {
+	b := &Base[*testData]{}
+	b.RegisterMQ(&dbq.Factory{})
+	if err := b.CheckTxPublish(); err != nil {
+		t.Error(err)
+	}
+	if hooks := b.TxHooks(); len(hooks) != 1 {
+		t.Errorf("expected 1 hook, got %d", len(hooks))
+	}
+	b.OutboxModel = &testOutbox{}
+	if err := b.CheckTxPublish(); err == nil {
+		t.Error("outbox with a transactional MQ should be rejected")
+	}
+}
@@ -24,6 +24,9 @@ type IAdapter[Data DataEntity] interface {
 	Update(c context.Context, task *Task[Data]) error
 
 	Publish(c context.Context, task *Task[Data]) error
+
+	QueryTaskHistory(c context.Context, taskID string) ([]*TaskHistory[Data], error)
+	QueryDataByVersion(c context.Context, taskID string, version uint) (Data, error)
 }
 
 type Adapter[Data DataEntity] struct {
@@ -39,6 +42,9 @@ type Adapter[Data DataEntity] struct {
 	ReUpdateCheck  func(c context.Context, task *Task[Data]) error
 	ReUpdate       func(c context.Context, task *Task[Data]) error
 	RePublish      func(c context.Context, task *Task[Data]) error
+
+	ReQueryTaskHistory   func(c context.Context, taskID string) ([]*TaskHistory[Data], error)
+	ReQueryDataByVersion func(c context.Context, taskID string, version uint) (Data, error)
 }
 
 func (a *Adapter[Data]) Init() error {
@@ -46,6 +52,12 @@ func (a *Adapter[Data]) Init() error {
 		return a.ReInit()
 	}
 
+	if err := a.FSM.Validate().Err(); err != nil {
+		return err
+	}
+	if err := a.CheckTxPublish(); err != nil {
+		return err
+	}
 	if err := a.InitDB((*a.Config)[a.GetDBSection()].(util.Config)); err != nil {
 		return err
 	}
@@ -82,6 +94,9 @@ func (a *Adapter[Data]) CreateCheck(c context.Context, task *Task[Data]) error {
 	if task.State == "" {
 		return fmt.Errorf("initial task.State should not be empty")
 	}
+	if !a.FSM.IsInitialState(task.State) {
+		return &InitialStateError{State: task.State, Initial: a.FSM.GetInitialStates()}
+	}
 	return nil
 }
 
@@ -102,7 +117,8 @@ func (a *Adapter[Data]) Create(c context.Context, task *Task[Data]) error {
 	if task.WithDB == nil {
 		task.WithDB = a.GetDB()
 	}
-	if err := internal.CreateTask(c, a.Models, task); err != nil {
+	hooks := append([]internal.TxHook[Data]{internal.OnEnterHook(a.FSM)}, a.TxHooks()...)
+	if err := internal.CreateTask(c, a.Models, task, hooks...); err != nil {
 		return err
 	}
 
@@ -194,7 +210,7 @@ func (a *Adapter[Data]) Update(c context.Context, task *Task[Data]) error {
 	if task.WithDB == nil {
 		task.WithDB = a.GetDB()
 	}
-	if err := internal.UpdateTask(c, a.Models, task, a.FSM); err != nil {
+	if err := internal.UpdateTask(c, a.Models, task, a.FSM, a.TxHooks()...); err != nil {
 		return err
 	}
 
@@ -210,10 +226,35 @@ func (a *Adapter[Data]) Publish(c context.Context, task *Task[Data]) error {
 		return a.RePublish(c, task)
 	}
 
-	if a.IMQ != nil {
-		if err := a.PublishMessage(c, task.ID); err != nil {
+	if a.IMQ != nil && !a.PublishedInTx() {
+		if err := a.PublishMessage(c, a.GenMessage(c, task)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// QueryTaskHistory Ordered transitions of the task with the Data snapshot at each version, requires RegisterFlowModel
+func (a *Adapter[Data]) QueryTaskHistory(c context.Context, taskID string) ([]*TaskHistory[Data], error) {
+	if a.ReQueryTaskHistory != nil {
+		return a.ReQueryTaskHistory(c, taskID)
+	}
+
+	if taskID == "" {
+		return nil, fmt.Errorf("taskID empty")
+	}
+	return internal.QueryTaskHistory[Data](c, a.GetDB(), a.Models, taskID)
+}
+
+// QueryDataByVersion The Data of the task as of the given version, requires RegisterFlowModel
+func (a *Adapter[Data]) QueryDataByVersion(c context.Context, taskID string, version uint) (Data, error) {
+	if a.ReQueryDataByVersion != nil {
+		return a.ReQueryDataByVersion(c, taskID, version)
+	}
+
+	if taskID == "" {
+		var data Data
+		return data, fmt.Errorf("taskID empty")
+	}
+	return internal.QueryDataByVersion[Data](c, a.GetDB(), a.Models, taskID, version)
+}
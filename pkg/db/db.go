@@ -9,4 +9,5 @@ type IDB interface {
 	GetDBSection() string
 	InitDB(config util.Config) error
 	GetDB() *gorm.DB
+	CloseDB() error
 }
@@ -84,3 +84,14 @@ func (f *Factory) InitDB(config util.Config) error {
 func (f *Factory) GetDB() *gorm.DB {
 	return f.DB
 }
+
+func (f *Factory) CloseDB() error {
+	if f.DB == nil {
+		return nil
+	}
+	sqlDB, err := f.DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
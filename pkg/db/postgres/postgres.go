@@ -0,0 +1,80 @@
+package postgres
+
+import (
+	"fmt"
+	"github.com/HEUDavid/go-fsm/pkg/util"
+	gormDriver "gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"time"
+)
+
+type Factory struct {
+	DB      *gorm.DB
+	Section string
+	config  util.Config
+	dsn     string
+}
+
+func (f *Factory) GetDBSection() string {
+	return f.Section
+}
+
+func (f *Factory) makeDsn() {
+	if dsn, ok := f.config["dsn"].(string); ok { // Takes precedence over the other keys
+		f.dsn = dsn
+		return
+	}
+	sslMode := f.config["sslMode"]
+	if sslMode == nil {
+		sslMode = "disable"
+	}
+	f.dsn = fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		f.config["host"],
+		f.config["port"],
+		f.config["user"],
+		f.config["password"],
+		f.config["dbName"],
+		sslMode,
+	)
+	if timeZone := f.config["timeZone"]; timeZone != nil {
+		f.dsn += fmt.Sprintf(" TimeZone=%s", timeZone)
+	}
+}
+
+func (f *Factory) InitDB(config util.Config) error {
+	f.config = config
+	f.makeDsn()
+
+	db, err := gorm.Open(gormDriver.Open(f.dsn), &gorm.Config{})
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return fmt.Errorf("error getting database connection pool: %w", err)
+	}
+
+	sqlDB.SetMaxOpenConns(int(f.config["maxOpenConns"].(int64)))
+	sqlDB.SetMaxIdleConns(int(f.config["maxIdleConns"].(int64)))
+	sqlDB.SetConnMaxLifetime(300 * time.Second)
+
+	f.DB = db
+
+	return nil
+}
+
+func (f *Factory) GetDB() *gorm.DB {
+	return f.DB
+}
+
+func (f *Factory) CloseDB() error {
+	if f.DB == nil {
+		return nil
+	}
+	sqlDB, err := f.DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
@@ -0,0 +1,102 @@
+package postgres
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/HEUDavid/go-fsm/internal"
+	. "github.com/HEUDavid/go-fsm/pkg/metadata"
+	"github.com/HEUDavid/go-fsm/pkg/util"
+)
+
+func TestInitDB(t *testing.T) {
+	factory := &Factory{Section: "postgres"}
+	config, ok := (*util.GetConfig())[factory.GetDBSection()].(util.Config)
+	if !ok {
+		t.Skipf("section %s not configured", factory.GetDBSection())
+	}
+	if err := factory.InitDB(config); err != nil {
+		t.Error(err)
+	}
+}
+
+type testData struct {
+	TaskID string `gorm:"primaryKey;column:task_id;type:char(32)"`
+	Amount int    `gorm:"column:amount"`
+}
+
+func (d *testData) TableName() string       { return "fsm_test_data" }
+func (d *testData) SetTaskID(taskID string) { d.TaskID = taskID }
+
+type testTask struct{ Task[*testData] }
+
+func (t *testTask) TableName() string { return "fsm_test_task" }
+
+type testUniqueRequest struct {
+	RequestID string `gorm:"primaryKey;column:request_id;type:char(32)"`
+	TaskID    string `gorm:"column:task_id;type:char(32)"`
+}
+
+func (u *testUniqueRequest) TableName() string { return "fsm_test_unique_request" }
+
+// TestIdempotency Runs against the database of FSM_POSTGRES_DSN, e.g.
+//
+//	FSM_POSTGRES_DSN="host=localhost user=postgres dbname=fsm" go test ./pkg/db/postgres -run TestIdempotency
+func TestIdempotency(t *testing.T) {
+	dsn := os.Getenv("FSM_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("FSM_POSTGRES_DSN not set")
+	}
+	factory := &Factory{}
+	if err := factory.InitDB(util.Config{"dsn": dsn, "maxOpenConns": int64(4), "maxIdleConns": int64(2)}); err != nil {
+		t.Fatal(err)
+	}
+	defer factory.CloseDB()
+
+	m := Models{DataModel: &testData{}, TaskModel: &testTask{}, UniqueRequestModel: &testUniqueRequest{}}
+	migrator := factory.GetDB().Migrator()
+	if err := migrator.AutoMigrate(m.DataModel, m.TaskModel, m.UniqueRequestModel); err != nil {
+		t.Fatal(err)
+	}
+	defer migrator.DropTable(m.DataModel, m.TaskModel, m.UniqueRequestModel)
+
+	var (
+		New = GenState[*testData]("New", false, nil)
+		Pay = GenState[*testData]("Pay", false, nil)
+		fsm = GenFSM[*testData]("TestFSM")
+	)
+	fsm.RegisterState(New, Pay)
+	fsm.RegisterTransition(GenTransition(New, Pay))
+
+	c := context.Background()
+	requestID, taskID := util.UniqueID(), util.UniqueID()
+	for _, id := range []string{taskID, util.UniqueID()} { // The second create is a duplicate request
+		task := GenTaskInstance(requestID, id, &testData{Amount: 100})
+		task.Type, task.State, task.Version, task.WithDB = "test", "New", 1, factory.GetDB()
+		if err := internal.CreateTask(c, m, task); err != nil {
+			t.Fatal(err)
+		}
+		if task.ID != taskID {
+			t.Errorf("duplicate create returned task %s, expected %s", task.ID, taskID)
+		}
+	}
+
+	requestID = util.UniqueID()
+	for i := 0; i < 2; i++ { // The second update is a duplicate request
+		task := GenTaskInstance(requestID, taskID, &testData{})
+		task.State, task.Version, task.WithDB = "Pay", 1, factory.GetDB()
+		if err := internal.UpdateTask(c, m, task, fsm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	task := GenTaskInstance("", taskID, &testData{})
+	task.WithDB = factory.GetDB()
+	if err := internal.QueryTask(c, m, task); err != nil {
+		t.Fatal(err)
+	}
+	if task.State != "Pay" || task.Version != 2 || task.Data.Amount != 100 {
+		t.Errorf("unexpected task: %s", util.Pretty(task))
+	}
+}
@@ -0,0 +1,78 @@
+package sqlite
+
+import (
+	"fmt"
+	"github.com/HEUDavid/go-fsm/pkg/util"
+	gormDriver "github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// Factory SQLite in pure Go, for local development and tests.
+// Config: path (":memory:" for an in-memory database), busyTimeout (milliseconds, default 5000), maxOpenConns (optional)
+type Factory struct {
+	DB      *gorm.DB
+	Section string
+	config  util.Config
+	dsn     string
+}
+
+func (f *Factory) GetDBSection() string {
+	return f.Section
+}
+
+func (f *Factory) makeDsn() {
+	busyTimeout := f.config["busyTimeout"]
+	if busyTimeout == nil {
+		busyTimeout = int64(5000)
+	}
+	if f.inMemory() {
+		f.dsn = fmt.Sprintf("file::memory:?_pragma=busy_timeout(%d)", busyTimeout)
+		return
+	}
+	f.dsn = fmt.Sprintf("file:%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)", f.config["path"], busyTimeout)
+}
+
+func (f *Factory) inMemory() bool {
+	path, _ := f.config["path"].(string)
+	return path == "" || path == ":memory:"
+}
+
+func (f *Factory) InitDB(config util.Config) error {
+	f.config = config
+	f.makeDsn()
+
+	db, err := gorm.Open(gormDriver.Open(f.dsn), &gorm.Config{})
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return fmt.Errorf("error getting database connection pool: %w", err)
+	}
+
+	if f.inMemory() { // Every connection opens its own in-memory database
+		sqlDB.SetMaxOpenConns(1)
+	} else if maxOpenConns, ok := f.config["maxOpenConns"].(int64); ok {
+		sqlDB.SetMaxOpenConns(int(maxOpenConns))
+	}
+
+	f.DB = db
+
+	return nil
+}
+
+func (f *Factory) GetDB() *gorm.DB {
+	return f.DB
+}
+
+func (f *Factory) CloseDB() error {
+	if f.DB == nil {
+		return nil
+	}
+	sqlDB, err := f.DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
@@ -0,0 +1,30 @@
+package sqlite
+
+import (
+	"github.com/HEUDavid/go-fsm/pkg/util"
+	"path/filepath"
+	"testing"
+)
+
+func TestInitDB(t *testing.T) {
+	factory := &Factory{Section: "sqlite"}
+	if err := factory.InitDB(util.Config{"path": filepath.Join(t.TempDir(), "fsm.db")}); err != nil {
+		t.Fatal(err)
+	}
+	defer factory.CloseDB()
+
+	type unique struct {
+		RequestID string `gorm:"primaryKey"`
+	}
+	gdb := factory.GetDB()
+	if err := gdb.AutoMigrate(&unique{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.Create(&unique{"r1"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	var loaded unique
+	if err := gdb.Take(&loaded).Error; err != nil || loaded.RequestID != "r1" {
+		t.Errorf("unexpected row %+v, %v", loaded, err)
+	}
+}
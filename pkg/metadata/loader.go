@@ -0,0 +1,182 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Definition is the declarative form of an FSM, loaded from YAML, TOML or JSON.
+// Handlers are referenced by key and bound from a Registry by BuildFSM.
+type Definition struct {
+	Name        string                 `json:"name" yaml:"name" toml:"name"`
+	DeadLetter  string                 `json:"deadLetter,omitempty" yaml:"deadLetter,omitempty" toml:"deadLetter,omitempty"` // Optional, a final state
+	States      []StateDefinition      `json:"states" yaml:"states" toml:"states"`
+	Transitions []TransitionDefinition `json:"transitions" yaml:"transitions" toml:"transitions"`
+}
+
+type StateDefinition struct {
+	Name    string           `json:"name" yaml:"name" toml:"name"`
+	Final   bool             `json:"final,omitempty" yaml:"final,omitempty" toml:"final,omitempty"`
+	Initial bool             `json:"initial,omitempty" yaml:"initial,omitempty" toml:"initial,omitempty"` // A task may be created in it
+	Handler string           `json:"handler,omitempty" yaml:"handler,omitempty" toml:"handler,omitempty"` // Key of Registry.Handlers
+	Timeout Duration         `json:"timeout,omitempty" yaml:"timeout,omitempty" toml:"timeout,omitempty"`
+	Retry   *RetryDefinition `json:"retry,omitempty" yaml:"retry,omitempty" toml:"retry,omitempty"`
+}
+
+type RetryDefinition struct {
+	MaxAttempts uint     `json:"maxAttempts,omitempty" yaml:"maxAttempts,omitempty" toml:"maxAttempts,omitempty"`
+	BaseDelay   Duration `json:"baseDelay,omitempty" yaml:"baseDelay,omitempty" toml:"baseDelay,omitempty"`
+	MaxDelay    Duration `json:"maxDelay,omitempty" yaml:"maxDelay,omitempty" toml:"maxDelay,omitempty"`
+	Jitter      float64  `json:"jitter,omitempty" yaml:"jitter,omitempty" toml:"jitter,omitempty"`
+}
+
+type TransitionDefinition struct {
+	From   string   `json:"from" yaml:"from" toml:"from"`
+	To     string   `json:"to" yaml:"to" toml:"to"`
+	Guards []string `json:"guards,omitempty" yaml:"guards,omitempty" toml:"guards,omitempty"` // Keys of Registry.Guards
+}
+
+// Duration is a time.Duration written as a string like "1m30s"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Registry binds the handler and guard keys of a Definition, use WithContext for handlers without context
+type Registry[Data DataEntity] struct {
+	Handlers map[string]HandlerFunc[Data]
+	Guards   map[string]GuardFunc[Data] // Named by their key in a GuardError
+}
+
+// ParseDefinition Parses a definition in the format yaml (yml), toml or json, unknown fields are rejected
+func ParseDefinition(data []byte, format string) (*Definition, error) {
+	d := &Definition{}
+	switch strings.ToLower(strings.TrimPrefix(format, ".")) {
+	case "yaml", "yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(d); err != nil {
+			return nil, fmt.Errorf("parse definition: %w", err)
+		}
+	case "toml":
+		meta, err := toml.Decode(string(data), d)
+		if err != nil {
+			return nil, fmt.Errorf("parse definition: %w", err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("parse definition: unknown fields %v", undecoded)
+		}
+	case "json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(d); err != nil {
+			return nil, fmt.Errorf("parse definition: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported definition format: %s", format)
+	}
+	return d, nil
+}
+
+// LoadDefinition Loads a definition file, the format is told by its extension
+func LoadDefinition(path string) (*Definition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDefinition(data, filepath.Ext(path))
+}
+
+// LoadFSM Loads a definition file and builds the FSM with the handlers of registry
+func LoadFSM[Data DataEntity](path string, registry Registry[Data]) (FSM[Data], error) {
+	d, err := LoadDefinition(path)
+	if err != nil {
+		return FSM[Data]{}, err
+	}
+	return BuildFSM(d, registry)
+}
+
+// BuildFSM Builds the FSM of a definition, it fails on unknown handler or guard keys and undeclared states
+func BuildFSM[Data DataEntity](d *Definition, registry Registry[Data]) (FSM[Data], error) {
+	fsm := GenFSM[Data](d.Name)
+
+	for _, sd := range d.States {
+		if _, exist := fsm.States[sd.Name]; exist {
+			return FSM[Data]{}, fmt.Errorf("state %s declared twice", sd.Name)
+		}
+		state := State[Data]{Name: sd.Name, IsFinal: sd.Final, Timeout: time.Duration(sd.Timeout)}
+		if sd.Handler != "" {
+			handler, ok := registry.Handlers[sd.Handler]
+			if !ok {
+				return FSM[Data]{}, fmt.Errorf("unknown handler %s of state %s", sd.Handler, sd.Name)
+			}
+			state.ContextHandler = handler
+		}
+		if sd.Retry != nil {
+			state = state.WithRetry(RetryPolicy{
+				MaxAttempts: sd.Retry.MaxAttempts,
+				BaseDelay:   time.Duration(sd.Retry.BaseDelay),
+				MaxDelay:    time.Duration(sd.Retry.MaxDelay),
+				Jitter:      sd.Retry.Jitter,
+			})
+		}
+		fsm.RegisterState(state)
+		if sd.Initial {
+			if sd.Final {
+				return FSM[Data]{}, fmt.Errorf("initial state %s should not be final", sd.Name)
+			}
+			fsm.RegisterInitialState(state)
+		}
+	}
+
+	if d.DeadLetter != "" {
+		state, exist := fsm.GetState(d.DeadLetter)
+		if !exist {
+			return FSM[Data]{}, fmt.Errorf("dead letter state %s not declared", d.DeadLetter)
+		}
+		if !state.IsFinalState() {
+			return FSM[Data]{}, fmt.Errorf("dead letter state %s should be final", d.DeadLetter)
+		}
+		fsm.RegisterDeadLetter(state)
+	}
+
+	for _, td := range d.Transitions {
+		from, exist := fsm.GetState(td.From)
+		if !exist {
+			return FSM[Data]{}, fmt.Errorf("state %s of transition %s->%s not declared", td.From, td.From, td.To)
+		}
+		to, exist := fsm.GetState(td.To)
+		if !exist {
+			return FSM[Data]{}, fmt.Errorf("state %s of transition %s->%s not declared", td.To, td.From, td.To)
+		}
+		transition := GenTransition(from, to)
+		for _, key := range td.Guards {
+			guard, ok := registry.Guards[key]
+			if !ok {
+				return FSM[Data]{}, fmt.Errorf("unknown guard %s of transition %s->%s", key, td.From, td.To)
+			}
+			transition = transition.WithGuard(key, guard)
+		}
+		fsm.RegisterTransition(transition)
+	}
+
+	return fsm, nil
+}
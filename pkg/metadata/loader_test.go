@@ -0,0 +1,157 @@
+package metadata
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+const payYAML = `
+name: PayFSM
+deadLetter: Failed
+states:
+  - name: New
+    initial: true
+    handler: new
+  - name: Pay
+    handler: pay
+    timeout: 30s
+    retry:
+      maxAttempts: 3
+      baseDelay: 1s
+      maxDelay: 1m
+      jitter: 0.2
+  - name: End
+    final: true
+  - name: Failed
+    final: true
+transitions:
+  - {from: New, to: Pay}
+  - {from: Pay, to: End, guards: [paid]}
+  - {from: Pay, to: Failed}
+`
+
+const payTOML = `
+name = "PayFSM"
+deadLetter = "Failed"
+
+[[states]]
+name = "New"
+initial = true
+handler = "new"
+
+[[states]]
+name = "Pay"
+handler = "pay"
+timeout = "30s"
+retry = { maxAttempts = 3, baseDelay = "1s", maxDelay = "1m", jitter = 0.2 }
+
+[[states]]
+name = "End"
+final = true
+
+[[states]]
+name = "Failed"
+final = true
+
+[[transitions]]
+from = "New"
+to = "Pay"
+
+[[transitions]]
+from = "Pay"
+to = "End"
+guards = ["paid"]
+
+[[transitions]]
+from = "Pay"
+to = "Failed"
+`
+
+const payJSON = `{
+  "name": "PayFSM",
+  "deadLetter": "Failed",
+  "states": [
+    {"name": "New", "initial": true, "handler": "new"},
+    {"name": "Pay", "handler": "pay", "timeout": "30s",
+      "retry": {"maxAttempts": 3, "baseDelay": "1s", "maxDelay": "1m", "jitter": 0.2}},
+    {"name": "End", "final": true},
+    {"name": "Failed", "final": true}
+  ],
+  "transitions": [
+    {"from": "New", "to": "Pay"},
+    {"from": "Pay", "to": "End", "guards": ["paid"]},
+    {"from": "Pay", "to": "Failed"}
+  ]
+}`
+
+var testRegistry = Registry[*testData]{Handlers: map[string]HandlerFunc[*testData]{
+	"new": WithContext(func(task *Task[*testData]) error {
+		task.State = "Pay"
+		return nil
+	}),
+	"pay": func(c context.Context, task *Task[*testData]) error {
+		task.State = "End"
+		return nil
+	},
+}, Guards: map[string]GuardFunc[*testData]{
+	"paid": func(c context.Context, current, next *Task[*testData]) bool { return true },
+}}
+
+func TestBuildFSM(t *testing.T) {
+	for format, data := range map[string]string{"yaml": payYAML, "toml": payTOML, "json": payJSON} {
+		d, err := ParseDefinition([]byte(data), format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		fsm, err := BuildFSM(d, testRegistry)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		pay, exist := fsm.GetState("Pay")
+		if !exist || pay.Timeout != 30*time.Second || pay.Retry == nil ||
+			*pay.Retry != (RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Minute, Jitter: 0.2}) {
+			t.Errorf("%s: unexpected state %+v", format, pay)
+		}
+		if deadLetter, ok := fsm.GetDeadLetter(); !ok || deadLetter.GetName() != "Failed" {
+			t.Errorf("%s: unexpected dead letter %+v", format, deadLetter)
+		}
+		if len(fsm.Initial) != 1 || !fsm.IsInitialState("New") || fsm.IsInitialState("Pay") {
+			t.Errorf("%s: unexpected initial states %v", format, fsm.Initial)
+		}
+		if pay2End, _ := fsm.GetTransition("Pay", "End"); len(pay2End.Guards) != 1 || pay2End.Guards[0].Name != "paid" {
+			t.Errorf("%s: unexpected guards %+v", format, pay2End.Guards)
+		}
+		if _, exist = fsm.GetTransition("Pay", "Failed"); !exist || len(fsm.Transitions) != 3 {
+			t.Errorf("%s: unexpected transitions %v", format, fsm.Transitions)
+		}
+
+		task := &Task[*testData]{State: "New"}
+		newState, _ := fsm.GetState("New")
+		if err = newState.HandleContext(context.Background(), task); err != nil || task.State != "Pay" {
+			t.Errorf("%s: handler not bound", format)
+		}
+	}
+}
+
+func TestBuildFSMErrors(t *testing.T) {
+	for _, c := range []struct{ replace, with, err string }{
+		{"handler: pay", "handler: refund", "unknown handler refund"},
+		{"guards: [paid]", "guards: [refunded]", "unknown guard refunded"},
+		{"{from: Pay, to: End,", "{from: Pay, to: Done,", "state Done of transition"},
+		{"deadLetter: Failed", "deadLetter: Pay", "should be final"},
+		{"final: true", "final: true\n    initial: true", "should not be final"},
+		{"timeout: 30s", "timeout: 30", "parse definition"},
+		{"timeout: 30s", "timeOut: 30s", "parse definition"},
+	} {
+		d, err := ParseDefinition([]byte(strings.Replace(payYAML, c.replace, c.with, 1)), "yml")
+		if err == nil {
+			_, err = BuildFSM(d, testRegistry)
+		}
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s -> %s: expected error %q, got %v", c.replace, c.with, c.err, err)
+		}
+	}
+}
@@ -12,6 +12,8 @@ type Models struct {
 	UniqueRequestModel schema.Tabler
 	TaskFlowModel      schema.Tabler // TaskFlow and DataFlow is optional, if not set,
 	DataFlowModel      schema.Tabler // no flow records will be kept
+	DeadLetterModel    schema.Tabler // Optional, records tasks whose retries are exhausted
+	OutboxModel        schema.Tabler // Optional, messages are written within the task transaction and relayed to the MQ
 }
 
 // DataEntity is data table which has all business columns
@@ -26,9 +28,10 @@ type Task[Data DataEntity] struct {
 	RequestID  string    `gorm:"unique;column:request_id;type:char(32);not null;comment:'初始请求ID'"`       // 初始请求ID
 	Type       string    `gorm:"column:type;type:varchar(128);not null;comment:'业务类型'"`                  // 业务类型
 	State      string    `gorm:"index:idx_state;column:state;type:varchar(128);not null;comment:'任务状态'"` // 任务状态
-	Version    uint      `gorm:"column:version;type:int unsigned;not null;default:1"`
+	Version    uint      `gorm:"column:version;size:32;not null;default:1"`
 	CreateTime time.Time `gorm:"column:create_time;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
 	UpdateTime time.Time `gorm:"column:update_time;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
+	Attempt    uint      `gorm:"<-:false;column:attempt;size:32;not null;default:0;comment:'当前状态已重试次数'"` // 当前状态已重试次数, 仅在使用RetryPolicy时需要此列
 
 	Data          Data     `gorm:"-"`          // Data: Customized Data Tables
 	SelectColumns []string `gorm:"-" json:"-"` // Data: Columns to update, including zero values
@@ -59,6 +62,48 @@ func (t *Task[Data]) SetOmitColumns(columns []string) {
 	t.OmitColumns = columns
 }
 
+// TaskFlow is the audit trail of Task, one immutable row is appended on create and on every transition.
+// The DataFlow table should have all columns of the Data table (except its primary key) plus `version`,
+// a snapshot of the Data row is kept for every version.
+type TaskFlow struct {
+	ID         uint64    `gorm:"primaryKey;autoIncrement;column:id"`
+	TaskID     string    `gorm:"uniqueIndex:uk_task_version;column:task_id;type:char(32);not null"`
+	RequestID  string    `gorm:"column:request_id;type:char(32);not null;comment:'本次请求ID'"`         // 本次请求ID
+	Type       string    `gorm:"column:type;type:varchar(128);not null;comment:'业务类型'"`             // 业务类型
+	FromState  string    `gorm:"column:from_state;type:varchar(128);not null;comment:'源状态, 创建时为空'"` // 源状态, 创建时为空
+	ToState    string    `gorm:"column:to_state;type:varchar(128);not null;comment:'目标状态'"`         // 目标状态
+	Version    uint      `gorm:"uniqueIndex:uk_task_version;column:version;size:32;not null"`
+	CreateTime time.Time `gorm:"column:create_time;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
+}
+
+// DeadLetter records a task whose retry budget of a state is used up
+type DeadLetter struct {
+	ID         uint64     `gorm:"primaryKey;autoIncrement;column:id"`
+	TaskID     string     `gorm:"index:idx_task_id;column:task_id;type:char(32);not null"`
+	State      string     `gorm:"column:state;type:varchar(128);not null;comment:'重试耗尽时所在状态'"` // 重试耗尽时所在状态
+	Version    uint       `gorm:"column:version;size:32;not null"`
+	Attempts   uint       `gorm:"column:attempts;size:32;not null;comment:'已尝试次数'"`                      // 已尝试次数
+	LastError  string     `gorm:"column:last_error;type:text;not null;comment:'最后一次错误'"`                 // 最后一次错误
+	StateTime  *time.Time `gorm:"column:state_time;type:timestamp;null;comment:'进入该状态的时间, 需记录TaskFlow'"` // 进入该状态的时间, 需记录TaskFlow
+	CreateTime time.Time  `gorm:"column:create_time;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
+}
+
+// Outbox is a message to be published, written in the same transaction as the task
+type Outbox struct {
+	ID         uint64     `gorm:"primaryKey;autoIncrement;column:id"`
+	TaskID     string     `gorm:"column:task_id;type:char(32);not null"`
+	Body       string     `gorm:"column:body;type:text;not null;comment:'消息内容'"`                               // 消息内容
+	Sent       bool       `gorm:"index:idx_sent;column:sent;type:bool;not null;default:false;comment:'是否已发送'"` // 是否已发送
+	CreateTime time.Time  `gorm:"column:create_time;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
+	SendTime   *time.Time `gorm:"column:send_time;type:timestamp;null"`
+}
+
+// TaskHistory is one TaskFlow row with the Data snapshot at its version
+type TaskHistory[Data DataEntity] struct {
+	TaskFlow
+	Data Data
+}
+
 func GenTaskInstance[Data DataEntity](requestID, taskID string, data Data) *Task[Data] {
 	task := &Task[Data]{Data: data}
 	task.RequestID = requestID
@@ -0,0 +1,80 @@
+package metadata
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// DefaultMaxDelay Caps the backoff of a RetryPolicy without MaxDelay
+const DefaultMaxDelay = time.Hour
+
+// RetryPolicy Backoff of a state whose handler returns an error, the task is published again after the delay
+type RetryPolicy struct {
+	MaxAttempts uint          // Attempts before giving up, 0 means no limit
+	BaseDelay   time.Duration // Delay of the first retry, doubled on each attempt
+	MaxDelay    time.Duration // Cap of the delay, 0 means DefaultMaxDelay
+	Jitter      float64       // [0, 1], the ratio of the delay to be randomized
+}
+
+// Backoff Delay before the given attempt (starting from 1)
+func (p RetryPolicy) Backoff(attempt uint) time.Duration {
+	delay := p.delay(attempt)
+
+	jitter := p.Jitter
+	if jitter > 1 {
+		jitter = 1
+	}
+	if jitter > 0 && delay > 0 {
+		spread := time.Duration(float64(delay) * jitter)
+		delay = delay - spread + time.Duration(rand.Int63n(int64(spread)+1))
+	}
+	return delay
+}
+
+// MaxBackoff The longest delay before a retry, a task may wait that long in its state before its next attempt
+func (p RetryPolicy) MaxBackoff() time.Duration {
+	if p.MaxAttempts == 1 { // Exhausted at the first failure
+		return 0
+	}
+	if p.MaxAttempts > 1 {
+		return p.delay(p.MaxAttempts - 1) // The last attempt is not followed by a retry
+	}
+	return p.delay(math.MaxUint)
+}
+
+// delay The backoff before jitter
+func (p RetryPolicy) delay(attempt uint) time.Duration {
+	maxDelay := p.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DefaultMaxDelay
+	}
+	delay := p.BaseDelay
+	for i := uint(1); i < attempt && delay > 0 && delay < maxDelay; i++ {
+		delay *= 2 // Stops at the cap, before overflowing
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// Exhausted Whether the retry budget is used up after the given attempts
+func (p RetryPolicy) Exhausted(attempts uint) bool {
+	return p.MaxAttempts > 0 && attempts >= p.MaxAttempts
+}
+
+// DelayError Returned by a handler to run the same state again after Delay, the task is not updated
+type DelayError struct {
+	Delay time.Duration
+}
+
+func (e *DelayError) Error() string {
+	return fmt.Sprintf("run again in %s", e.Delay)
+}
+
+// RetryAfter Tells the worker to run the handler again after delay without changing the state
+func RetryAfter(delay time.Duration) error {
+	return &DelayError{Delay: delay}
+}
@@ -0,0 +1,48 @@
+package metadata
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, e := range expected {
+		if d := p.Backoff(uint(i + 1)); d != e {
+			t.Errorf("attempt %d: %s, expected %s", i+1, d, e)
+		}
+	}
+	if p.Exhausted(4) || !p.Exhausted(5) {
+		t.Error("Exhausted error")
+	}
+
+	unlimited := RetryPolicy{BaseDelay: time.Second}
+	for _, attempt := range []uint{64, 100, 1 << 20} {
+		if d := unlimited.Backoff(attempt); d != DefaultMaxDelay {
+			t.Errorf("attempt %d: %s, expected %s", attempt, d, DefaultMaxDelay)
+		}
+	}
+
+	if p.MaxBackoff() != 5*time.Second || unlimited.MaxBackoff() != DefaultMaxDelay {
+		t.Errorf("unexpected MaxBackoff: %s, %s", p.MaxBackoff(), unlimited.MaxBackoff())
+	}
+	if short := (RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second}); short.MaxBackoff() != 2*time.Second {
+		t.Errorf("unexpected MaxBackoff: %s", short.MaxBackoff())
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.Backoff(3); d < 2*time.Second || d > 4*time.Second {
+			t.Fatalf("jitter out of range: %s", d)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var delayErr *DelayError
+	if err := RetryAfter(time.Minute); !errors.As(err, &delayErr) || delayErr.Delay != time.Minute {
+		t.Error(err)
+	}
+}
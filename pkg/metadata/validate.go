@@ -0,0 +1,132 @@
+package metadata
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ValidationReport lists the problems of an FSM found by Validate
+type ValidationReport struct {
+	Empty            bool     // No states registered
+	Unregistered     []string // States used by transitions but not registered
+	Unreachable      []string // Registered states no path from an initial state (see GetInitialStates) leads to
+	DeadEnds         []string // Non-final states without transitions to other states
+	MissingInitial   bool     // No initial state declared, and every state has incoming transitions
+	Duplicates       []string // States registered more than once
+	Conflicts        []string // States whose definition in a transition differs from the registered one
+	FinalWithHandler []string // Final states with a handler, which is never run
+	NoDeadLetter     []string // States with a RetryPolicy but no transition to the dead letter state
+}
+
+func (r *ValidationReport) OK() bool {
+	return !r.Empty && len(r.Unregistered) == 0 && len(r.Unreachable) == 0 && len(r.DeadEnds) == 0 && !r.MissingInitial &&
+		len(r.Duplicates) == 0 && len(r.Conflicts) == 0 && len(r.FinalWithHandler) == 0 && len(r.NoDeadLetter) == 0
+}
+
+// Err Returns nil if OK
+func (r *ValidationReport) Err() error {
+	if r.OK() {
+		return nil
+	}
+	return r
+}
+
+func (r *ValidationReport) Error() string {
+	if r.Empty {
+		return "invalid FSM: no states"
+	}
+	var problems []string
+	for _, p := range []struct {
+		name   string
+		states []string
+	}{
+		{"unregistered states", r.Unregistered},
+		{"unreachable states", r.Unreachable},
+		{"dead ends", r.DeadEnds},
+		{"duplicate states", r.Duplicates},
+		{"conflicting states", r.Conflicts},
+		{"final states with handler", r.FinalWithHandler},
+		{"states without transition to the dead letter", r.NoDeadLetter},
+	} {
+		if len(p.states) > 0 {
+			problems = append(problems, fmt.Sprintf("%s: %s", p.name, strings.Join(p.states, ", ")))
+		}
+	}
+	if r.MissingInitial {
+		problems = append(problems, "missing initial state")
+	}
+	return "invalid FSM: " + strings.Join(problems, "; ")
+}
+
+// Validate Checks the FSM statically, a Worker or Adapter refuses to start if it is not OK
+func (f *FSM[Data]) Validate() *ValidationReport {
+	r := &ValidationReport{Empty: len(f.States) == 0, Duplicates: sortedKeys(f.duplicates)}
+
+	unregistered, conflicts := map[string]bool{}, map[string]bool{}
+	outgoing := map[string]bool{}
+	next := map[string][]string{}
+	for _, t := range f.Transitions {
+		for _, s := range []State[Data]{t.From, t.To} {
+			registered, exist := f.States[s.GetName()]
+			if !exist {
+				unregistered[s.GetName()] = true
+			} else if registered.IsFinalState() != s.IsFinalState() {
+				conflicts[s.GetName()] = true
+			}
+		}
+		from, to := t.From.GetName(), t.To.GetName()
+		if from != to {
+			outgoing[from] = true
+			next[from] = append(next[from], to)
+		}
+	}
+	r.Unregistered = sortedKeys(unregistered)
+	r.Conflicts = sortedKeys(conflicts)
+
+	for name, state := range f.States {
+		if !state.IsFinalState() && !outgoing[name] {
+			r.DeadEnds = append(r.DeadEnds, name)
+		}
+		if state.IsFinalState() && (state.Handler != nil || state.ContextHandler != nil) {
+			r.FinalWithHandler = append(r.FinalWithHandler, name)
+		}
+		if _, exist := f.GetTransition(name, f.DeadLetter); f.DeadLetter != "" && state.Retry != nil && !exist {
+			r.NoDeadLetter = append(r.NoDeadLetter, name)
+		}
+	}
+	sort.Strings(r.DeadEnds)
+	sort.Strings(r.FinalWithHandler)
+	sort.Strings(r.NoDeadLetter)
+	initial := f.GetInitialStates()
+	r.MissingInitial = len(initial) == 0 && len(f.States) > 0
+
+	reachable := map[string]bool{}
+	for queue := slices.Clone(initial); len(queue) > 0; queue = queue[1:] {
+		if reachable[queue[0]] {
+			continue
+		}
+		reachable[queue[0]] = true
+		queue = append(queue, next[queue[0]]...)
+	}
+	if !r.MissingInitial {
+		for name := range f.States {
+			if !reachable[name] {
+				r.Unreachable = append(r.Unreachable, name)
+			}
+		}
+		sort.Strings(r.Unreachable)
+	}
+
+	return r
+}
+
+func sortedKeys(set map[string]bool) []string {
+	var names []string
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
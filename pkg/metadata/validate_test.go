@@ -0,0 +1,77 @@
+package metadata
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFSM_Validate(t *testing.T) {
+	var (
+		New     = GenState[*testData]("New", false, nil)
+		Pay     = GenState[*testData]("Pay", false, nil)
+		Check   = GenState[*testData]("Check", false, nil)
+		Refund  = GenState[*testData]("Refund", false, nil)
+		Retry   = GenState[*testData]("Retry", false, nil)
+		End     = GenState[*testData]("End", true, func(task *Task[*testData]) error { return nil })
+		Lost    = GenState[*testData]("Lost", true, nil)
+		Invalid = GenState[*testData]("Invalid", false, nil)
+	)
+	fsm := GenFSM[*testData]("Broken")
+	fsm.RegisterState(New, Pay, Check, Refund, Retry, End, Pay)
+	fsm.RegisterTransition(
+		GenTransition(New, Pay),
+		GenTransition(Pay, End),
+		GenTransition(Pay, Check),
+		GenTransition(Refund, Retry),
+		GenTransition(Retry, Refund),
+		GenTransition(Pay, Lost),
+		GenTransition(State[*testData]{Name: "End"}, Invalid),
+	)
+
+	r := fsm.Validate()
+	expected := &ValidationReport{
+		Unregistered:     []string{"Invalid", "Lost"},
+		Unreachable:      []string{"Refund", "Retry"},
+		DeadEnds:         []string{"Check"},
+		Duplicates:       []string{"Pay"},
+		Conflicts:        []string{"End"},
+		FinalWithHandler: []string{"End"},
+	}
+	if !reflect.DeepEqual(r, expected) {
+		t.Errorf("unexpected report: %+v", r)
+	}
+	if r.OK() || r.Err() == nil {
+		t.Error("report should not be OK")
+	}
+
+	cyclic := GenFSM[*testData]("Cyclic")
+	cyclic.RegisterState(Refund, Retry)
+	cyclic.RegisterTransition(GenTransition(Refund, Retry), GenTransition(Retry, Refund))
+	if r = cyclic.Validate(); !r.MissingInitial || r.Err() == nil {
+		t.Errorf("unexpected report: %+v", r)
+	}
+
+	declared := GenFSM[*testData]("Declared")
+	declared.RegisterState(New, Pay, End)
+	declared.RegisterInitialState(Pay)
+	declared.RegisterTransition(GenTransition(New, Pay), GenTransition(Pay, End))
+	if r = declared.Validate(); !reflect.DeepEqual(r.Unreachable, []string{"New"}) {
+		t.Errorf("unexpected report: %+v", r)
+	}
+	if declared.IsInitialState("New") || !declared.IsInitialState("Pay") {
+		t.Errorf("unexpected initial states: %v", declared.GetInitialStates())
+	}
+
+	empty := GenFSM[*testData]("Empty")
+	if r = empty.Validate(); !r.Empty || r.Err() == nil {
+		t.Errorf("unexpected report: %+v", r)
+	}
+
+	retried := GenFSM[*testData]("Retried")
+	retried.RegisterState(New, Pay.WithRetry(RetryPolicy{MaxAttempts: 3}), End)
+	retried.RegisterDeadLetter(Lost)
+	retried.RegisterTransition(GenTransition(New, Pay), GenTransition(Pay, End))
+	if r = retried.Validate(); !reflect.DeepEqual(r.NoDeadLetter, []string{"Pay"}) || r.Err() == nil {
+		t.Errorf("unexpected report: %+v", r)
+	}
+}
@@ -3,6 +3,7 @@ package metadata
 import (
 	"context"
 	"fmt"
+	"gorm.io/gorm"
 	"os"
 	"oss.terrastruct.com/d2/d2compiler"
 	"oss.terrastruct.com/d2/d2exporter"
@@ -10,7 +11,10 @@ import (
 	"oss.terrastruct.com/d2/d2renderers/d2svg"
 	"oss.terrastruct.com/d2/d2themes/d2themescatalog"
 	"oss.terrastruct.com/d2/lib/textmeasure"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 )
 
 type IState[Data DataEntity] interface {
@@ -19,24 +23,99 @@ type IState[Data DataEntity] interface {
 	Handle(task *Task[Data]) error
 }
 
+// IContextState is a state whose handler can see the message context, implemented by State
+type IContextState[Data DataEntity] interface {
+	IState[Data]
+	HandleContext(c context.Context, task *Task[Data]) error
+}
+
+// HandlerFunc is a state handler which can see the message context, deadlines and cancellation
+type HandlerFunc[Data DataEntity] func(c context.Context, task *Task[Data]) error
+
 type State[Data DataEntity] struct {
-	Name    string
-	IsFinal bool
-	Handler func(task *Task[Data]) error
+	Name           string
+	IsFinal        bool
+	Handler        func(task *Task[Data]) error // Handler without context, adapted by WithContext
+	ContextHandler HandlerFunc[Data]            // Takes precedence over Handler
+	Retry          *RetryPolicy                 // Optional, without it a failed handler is redelivered by the MQ at once
+	Timeout        time.Duration                // Optional, the worker gives up the handler after Timeout
+	OnEnter        TxCallback[Data]             // Optional, run when a task is created in or moves into the state
+	OnExit         TxCallback[Data]             // Optional, run when a task moves out of the state
+}
+
+// TxCallback runs within the transaction writing the task, after the task and its Data are written.
+// Rows written with tx are committed atomically with the state change, an error rolls it back.
+type TxCallback[Data DataEntity] func(c context.Context, tx *gorm.DB, task *Task[Data]) error
+
+// CallbackError Returned by a create or update when a TxCallback fails, the task is left untouched
+type CallbackError struct {
+	Callback string // e.g. "on enter Pay"
+	Err      error
+}
+
+func (e *CallbackError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Callback, e.Err)
+}
+
+func (e *CallbackError) Unwrap() error {
+	return e.Err
 }
 
 func (s State[Data]) GetName() string    { return s.Name }
 func (s State[Data]) IsFinalState() bool { return s.IsFinal }
 func (s State[Data]) Handle(task *Task[Data]) error {
+	return s.HandleContext(context.Background(), task)
+}
+
+// HandleContext Runs the handler with the message context, the Worker calls it instead of Handle
+func (s State[Data]) HandleContext(c context.Context, task *Task[Data]) error {
+	if s.ContextHandler != nil {
+		return s.ContextHandler(c, task)
+	}
 	if s.Handler != nil {
-		return s.Handler(task)
+		return WithContext(s.Handler)(c, task)
 	}
 
 	panic(fmt.Sprintf("[FSM] implement me: %s", s.GetName()))
 }
 
+// WithContext Adapts a handler without context to HandlerFunc
+func WithContext[Data DataEntity](handler func(task *Task[Data]) error) HandlerFunc[Data] {
+	return func(c context.Context, task *Task[Data]) error {
+		return handler(task)
+	}
+}
+
 func GenState[Data DataEntity](name string, isFinal bool, handler func(task *Task[Data]) error) State[Data] {
-	return State[Data]{name, isFinal, handler}
+	return State[Data]{Name: name, IsFinal: isFinal, Handler: handler}
+}
+
+func GenContextState[Data DataEntity](name string, isFinal bool, handler HandlerFunc[Data]) State[Data] {
+	return State[Data]{Name: name, IsFinal: isFinal, ContextHandler: handler}
+}
+
+// WithTimeout Returns a copy of the state whose handler is given up after timeout
+func (s State[Data]) WithTimeout(timeout time.Duration) State[Data] {
+	s.Timeout = timeout
+	return s
+}
+
+// WithRetry Returns a copy of the state using the retry policy
+func (s State[Data]) WithRetry(policy RetryPolicy) State[Data] {
+	s.Retry = &policy
+	return s
+}
+
+// WithOnEnter Returns a copy of the state running callback when a task is created in or moves into it
+func (s State[Data]) WithOnEnter(callback TxCallback[Data]) State[Data] {
+	s.OnEnter = callback
+	return s
+}
+
+// WithOnExit Returns a copy of the state running callback when a task moves out of it
+func (s State[Data]) WithOnExit(callback TxCallback[Data]) State[Data] {
+	s.OnExit = callback
+	return s
 }
 
 type ITransition[Data DataEntity] interface {
@@ -44,8 +123,10 @@ type ITransition[Data DataEntity] interface {
 }
 
 type Transition[Data DataEntity] struct {
-	From State[Data]
-	To   State[Data]
+	From         State[Data]
+	To           State[Data]
+	Guards       []Guard[Data]    // Optional, all of them should pass for the transition to be taken
+	OnTransition TxCallback[Data] // Optional, run when the transition is taken, between OnExit and OnEnter
 }
 
 func (t Transition[Data]) GetName() string {
@@ -53,7 +134,48 @@ func (t Transition[Data]) GetName() string {
 }
 
 func GenTransition[Data DataEntity](from, to State[Data]) Transition[Data] {
-	return Transition[Data]{from, to}
+	return Transition[Data]{From: from, To: to}
+}
+
+// WithOnTransition Returns a copy of the transition running callback when it is taken
+func (t Transition[Data]) WithOnTransition(callback TxCallback[Data]) Transition[Data] {
+	t.OnTransition = callback
+	return t
+}
+
+// GuardFunc Decides whether the task may move from current, freshly loaded in the update transaction
+// together with its Data, to next, the task being updated.
+type GuardFunc[Data DataEntity] func(c context.Context, current, next *Task[Data]) bool
+
+type Guard[Data DataEntity] struct {
+	Name  string
+	Check GuardFunc[Data]
+}
+
+// WithGuard Returns a copy of the transition guarded by check, reported by name when it rejects the transition
+func (t Transition[Data]) WithGuard(name string, check GuardFunc[Data]) Transition[Data] {
+	t.Guards = append(slices.Clip(t.Guards), Guard[Data]{Name: name, Check: check})
+	return t
+}
+
+// CheckGuards Runs the guards in order, a GuardError names the first one rejecting the transition
+func (t Transition[Data]) CheckGuards(c context.Context, current, next *Task[Data]) error {
+	for _, guard := range t.Guards {
+		if !guard.Check(c, current, next) {
+			return &GuardError{Transition: t.GetName(), Guard: guard.Name}
+		}
+	}
+	return nil
+}
+
+// GuardError Returned by an update when a guard of the transition rejects it
+type GuardError struct {
+	Transition string
+	Guard      string
+}
+
+func (e *GuardError) Error() string {
+	return fmt.Sprintf("cannot transition, %s rejected by guard %s", e.Transition, e.Guard)
 }
 
 type IFSM[Data DataEntity] interface {
@@ -61,12 +183,21 @@ type IFSM[Data DataEntity] interface {
 	RegisterTransition(transitions ...Transition[Data])
 	GetState(state string) (State[Data], bool)
 	GetTransition(fromState, toState string) (Transition[Data], bool)
+	RegisterDeadLetter(state State[Data])
+	GetDeadLetter() (State[Data], bool)
+	RegisterInitialState(states ...State[Data])
+	GetInitialStates() []string
+	Validate() *ValidationReport
 }
 
 type FSM[Data DataEntity] struct {
 	Name        string
 	States      map[string]State[Data]
 	Transitions map[string]Transition[Data]
+	DeadLetter  string   // Optional, the final state a task is moved into when its retry budget is used up
+	Initial     []string // Optional, the states a task may be created in, see GetInitialStates
+
+	duplicates map[string]bool // States registered more than once, see Validate
 }
 
 func (f *FSM[Data]) GetState(state string) (State[Data], bool) {
@@ -81,6 +212,12 @@ func (f *FSM[Data]) GetTransition(fromState, toState string) (Transition[Data],
 
 func (f *FSM[Data]) RegisterState(states ...State[Data]) {
 	for _, state := range states {
+		if _, exist := f.States[state.GetName()]; exist {
+			if f.duplicates == nil {
+				f.duplicates = map[string]bool{}
+			}
+			f.duplicates[state.GetName()] = true
+		}
 		f.States[state.GetName()] = state
 	}
 }
@@ -91,6 +228,77 @@ func (f *FSM[Data]) RegisterTransition(transitions ...Transition[Data]) {
 	}
 }
 
+// RegisterDeadLetter Declares the final state for tasks whose retries are exhausted, registered if not yet,
+// transitions into it still need to be registered.
+func (f *FSM[Data]) RegisterDeadLetter(state State[Data]) {
+	if !state.IsFinalState() {
+		panic(fmt.Sprintf("[FSM] dead letter state %s should be final", state.GetName()))
+	}
+	if _, exist := f.GetState(state.GetName()); !exist {
+		f.RegisterState(state)
+	}
+	f.DeadLetter = state.GetName()
+}
+
+func (f *FSM[Data]) GetDeadLetter() (State[Data], bool) {
+	if f.DeadLetter == "" {
+		return State[Data]{}, false
+	}
+	return f.GetState(f.DeadLetter)
+}
+
+// RegisterInitialState Declares the states a task may be created in, registered if not yet
+func (f *FSM[Data]) RegisterInitialState(states ...State[Data]) {
+	for _, state := range states {
+		if state.IsFinalState() {
+			panic(fmt.Sprintf("[FSM] initial state %s should not be final", state.GetName()))
+		}
+		if _, exist := f.GetState(state.GetName()); !exist {
+			f.RegisterState(state)
+		}
+		if !slices.Contains(f.Initial, state.GetName()) {
+			f.Initial = append(f.Initial, state.GetName())
+		}
+	}
+}
+
+// GetInitialStates Returns the declared initial states, or if none is declared,
+// the registered states without transitions from other states into them.
+func (f *FSM[Data]) GetInitialStates() []string {
+	if len(f.Initial) > 0 {
+		return f.Initial
+	}
+
+	incoming := map[string]bool{}
+	for _, t := range f.Transitions {
+		if t.From.GetName() != t.To.GetName() {
+			incoming[t.To.GetName()] = true
+		}
+	}
+	var roots []string
+	for name := range f.States {
+		if !incoming[name] {
+			roots = append(roots, name)
+		}
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+func (f *FSM[Data]) IsInitialState(state string) bool {
+	return slices.Contains(f.GetInitialStates(), state)
+}
+
+// InitialStateError Returned by Create when the task is not in an initial state of the FSM
+type InitialStateError struct {
+	State   string
+	Initial []string
+}
+
+func (e *InitialStateError) Error() string {
+	return fmt.Sprintf("task.State %s is not an initial state, expected one of [%s]", e.State, strings.Join(e.Initial, ", "))
+}
+
 func (f *FSM[Data]) Description() string {
 	var transitions []string
 	for _, t := range f.Transitions {
@@ -1,6 +1,9 @@
 package metadata
 
-import "testing"
+import (
+	"path/filepath"
+	"testing"
+)
 
 type testData struct{}
 
@@ -19,6 +22,7 @@ func TestFSM_Draw(t *testing.T) {
 		PayFail  = State[*testData]{Name: "PayFail", IsFinal: true}
 	)
 	fsm := GenFSM[*testData]("AUDITS")
+	fsm.RegisterState(New, Frozen, Audit, Approved, Rejected, Pay, PaySucc, PayFail)
 	fsm.RegisterTransition(
 		GenTransition(New, Frozen),
 		GenTransition(Frozen, Audit),
@@ -28,7 +32,10 @@ func TestFSM_Draw(t *testing.T) {
 		GenTransition(Pay, PaySucc),
 		GenTransition(Pay, PayFail),
 	)
-	if err := fsm.Draw("audits.svg"); err != nil {
+	if err := fsm.Validate().Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsm.Draw(filepath.Join(t.TempDir(), "audits.svg")); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -10,14 +10,32 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"log"
+	"strconv"
 	"time"
 )
 
+const (
+	maxDelaySeconds          = 900
+	maxBatchSize             = 10
+	defaultVisibilityTimeout = 30                     // Seconds, the SQS default
+	deleteWait               = 100 * time.Millisecond // The longest an ack waits for its batch delete
+)
+
+// Factory Amazon SQS, several pollers receive messages in batches, acked messages are deleted in batches.
+// The visibility timeout of a message is extended while it waits in the buffer and is being handled.
+// Config: queue, accessKey, secretKey, region, batchSize (1 to 10, default 10), pollers (default 1),
+// visibilityTimeout (seconds, default 30)
 type Factory struct {
-	Section string
-	buffer  chan *mq.Message
-	queue   string
-	sqs     *sqs.SQS
+	Section           string
+	buffer            chan *mq.Message
+	deletions         chan deletion
+	queue             string
+	sqs               *sqs.SQS
+	batchSize         int64
+	pollers           int
+	visibilityTimeout int64
+	ctx               context.Context // Done when stopped
+	stop              context.CancelFunc
 }
 
 func (f *Factory) GetMQSection() string {
@@ -41,7 +59,28 @@ func (f *Factory) InitMQ(config util.Config) error {
 
 	f.sqs = sqs.New(sess)
 
+	f.batchSize = maxBatchSize
+	if batchSize, ok := config["batchSize"].(int64); ok {
+		if batchSize < 1 || batchSize > maxBatchSize {
+			return fmt.Errorf("sqs batchSize should be between 1 and %d", maxBatchSize)
+		}
+		f.batchSize = batchSize
+	}
+	f.pollers = 1
+	if pollers, ok := config["pollers"].(int64); ok && pollers > 0 {
+		f.pollers = int(pollers)
+	}
+	f.visibilityTimeout = defaultVisibilityTimeout
+	if visibilityTimeout, ok := config["visibilityTimeout"].(int64); ok {
+		if visibilityTimeout < 2 {
+			return fmt.Errorf("sqs visibilityTimeout should be at least 2 seconds")
+		}
+		f.visibilityTimeout = visibilityTimeout
+	}
+
 	f.buffer = make(chan *mq.Message)
+	f.deletions = make(chan deletion)
+	f.ctx, f.stop = context.WithCancel(context.Background())
 
 	return nil
 }
@@ -56,57 +95,188 @@ func (f *Factory) PublishMessage(c context.Context, msg string) error {
 	return nil
 }
 
+// PublishDelayMessage SQS delays a message for 15 minutes at most, longer delays are capped
+func (f *Factory) PublishDelayMessage(c context.Context, msg string, delay time.Duration) error {
+	seconds := int64(delay.Round(time.Second) / time.Second)
+	if seconds > maxDelaySeconds {
+		seconds = maxDelaySeconds
+	}
+	if _, err := f.sqs.SendMessage(&sqs.SendMessageInput{
+		MessageBody:  &msg,
+		QueueUrl:     &f.queue,
+		DelaySeconds: aws.Int64(seconds),
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (f *Factory) FetchMessage(c context.Context) mq.Message {
-	msg, ok := <-f.buffer
-	if !ok {
-		return mq.Message{C: c}
+	select {
+	case msg := <-f.buffer:
+		return *msg
+	case <-c.Done():
+	case <-f.ctx.Done():
 	}
-	return *msg
+	return mq.Message{C: c}
 }
 
 func (f *Factory) Start() {
-	go func() {
-		for {
-			result, err := f.sqs.ReceiveMessage(&sqs.ReceiveMessageInput{
-				QueueUrl:            &f.queue,
-				MaxNumberOfMessages: aws.Int64(1),
-				WaitTimeSeconds:     aws.Int64(20),
-			})
-			if err != nil {
-				log.Printf("[FSM] sqs receiving message Err: %v", err)
-				continue
+	go f.deleteBatches()
+	for i := 0; i < f.pollers; i++ {
+		go f.poll()
+	}
+}
+
+func (f *Factory) Stop() {
+	if f.stop == nil { // Not initialized
+		return
+	}
+	f.stop()
+}
+
+func (f *Factory) poll() {
+	for f.ctx.Err() == nil {
+		input := &sqs.ReceiveMessageInput{
+			QueueUrl:            &f.queue,
+			MaxNumberOfMessages: aws.Int64(f.batchSize),
+			WaitTimeSeconds:     aws.Int64(20),
+			VisibilityTimeout:   aws.Int64(f.visibilityTimeout),
+		}
+		result, err := f.sqs.ReceiveMessageWithContext(f.ctx, input)
+		if err != nil {
+			if f.ctx.Err() != nil { // Stopped
+				return
 			}
+			log.Printf("[FSM] sqs receiving message Err: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
 
-			for _, message := range result.Messages {
-				f.buffer <- &mq.Message{
-					C:    context.Background(),
-					Body: *message.Body,
-
-					Ack: func() error {
-						if _, e := f.sqs.DeleteMessage(&sqs.DeleteMessageInput{
-							QueueUrl:      &f.queue,
-							ReceiptHandle: message.ReceiptHandle,
-						}); e != nil {
-							return fmt.Errorf("error delete message: %w", e)
-						}
-						return nil
-					},
-
-					Nack: func() error {
-						if _, e := f.sqs.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
-							QueueUrl:          &f.queue,
-							ReceiptHandle:     message.ReceiptHandle,
-							VisibilityTimeout: aws.Int64(0),
-						}); e != nil {
-							return fmt.Errorf("error change message visibility: %w", e)
-						}
-						return nil
-					},
-				}
+		// Every message of the batch is renewed at once, not only when handed over,
+		// the rest of the batch waits for the buffer while the first is handled.
+		leases := make([]*mq.Lease, len(result.Messages))
+		for i, message := range result.Messages {
+			leases[i] = f.lease(message)
+		}
+		for i, message := range result.Messages {
+			if !f.deliver(message, leases[i]) { // Stopped, the renewal of the rest ends as well
+				return
 			}
+		}
+	}
+}
 
-			time.Sleep(time.Second)
+// lease Extends the visibility timeout of the message until it is acked or nacked
+func (f *Factory) lease(message *sqs.Message) *mq.Lease {
+	return mq.NewLease(f.ctx, time.Duration(f.visibilityTimeout)*time.Second/2, func() bool {
+		if _, err := f.sqs.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          &f.queue,
+			ReceiptHandle:     message.ReceiptHandle,
+			VisibilityTimeout: aws.Int64(f.visibilityTimeout),
+		}); err != nil {
+			log.Printf("[FSM] sqs extending visibility timeout Err: %v", err)
+		}
+		return true
+	})
+}
+
+// deliver Hands the message to FetchMessage
+func (f *Factory) deliver(message *sqs.Message, lease *mq.Lease) bool {
+	already := fmt.Errorf("message %s already settled", *message.MessageId)
+
+	return lease.Deliver(f.ctx, f.buffer, &mq.Message{ // Not deleted if stopped, visible again after the visibility timeout
+		C:    context.Background(),
+		Body: *message.Body,
+		Ack: func() error {
+			return lease.Settle(func() error { return f.delete(message) }, already)
+		},
+		Nack: func() error {
+			return lease.Settle(func() error {
+				if _, e := f.sqs.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          &f.queue,
+					ReceiptHandle:     message.ReceiptHandle,
+					VisibilityTimeout: aws.Int64(0),
+				}); e != nil {
+					return fmt.Errorf("error change message visibility: %w", e)
+				}
+				return nil
+			}, already)
+		},
+	})
+}
+
+// deletion is an acked message waiting for the batch delete
+type deletion struct {
+	message *sqs.Message
+	result  chan error
+}
+
+// delete Waits for the batch delete of the message, or deletes it alone when stopped
+func (f *Factory) delete(message *sqs.Message) error {
+	d := deletion{message: message, result: make(chan error, 1)}
+	select {
+	case f.deletions <- d:
+		return <-d.result
+	case <-f.ctx.Done():
+	}
+	if _, e := f.sqs.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      &f.queue,
+		ReceiptHandle: message.ReceiptHandle,
+	}); e != nil {
+		return fmt.Errorf("error delete message: %w", e)
+	}
+	return nil
+}
+
+// deleteBatches Deletes the acked messages in batches of up to 10, a batch is sent when full or after deleteWait
+func (f *Factory) deleteBatches() {
+	var batch []deletion
+	timer := time.NewTimer(deleteWait)
+	timer.Stop()
+	for {
+		select {
+		case d := <-f.deletions:
+			if len(batch) == 0 {
+				timer.Reset(deleteWait)
+			}
+			batch = append(batch, d)
+			if len(batch) < maxBatchSize {
+				continue
+			}
+			timer.Stop()
+		case <-timer.C:
+		case <-f.ctx.Done():
+			if len(batch) > 0 {
+				f.deleteBatch(batch)
+			}
+			return
 		}
+		f.deleteBatch(batch)
+		batch = nil
+	}
+}
 
-	}()
+func (f *Factory) deleteBatch(batch []deletion) {
+	entries := make([]*sqs.DeleteMessageBatchRequestEntry, len(batch))
+	for i, d := range batch {
+		entries[i] = &sqs.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: d.message.ReceiptHandle,
+		}
+	}
+	result, err := f.sqs.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{QueueUrl: &f.queue, Entries: entries})
+	if err != nil {
+		for _, d := range batch {
+			d.result <- fmt.Errorf("error delete message: %w", err)
+		}
+		return
+	}
+	failed := map[string]error{}
+	for _, entry := range result.Failed {
+		failed[*entry.Id] = fmt.Errorf("error delete message: %s", aws.StringValue(entry.Message))
+	}
+	for i, d := range batch {
+		d.result <- failed[strconv.Itoa(i)]
+	}
 }
@@ -0,0 +1,114 @@
+package aws
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/HEUDavid/go-fsm/pkg/util"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func config() util.Config {
+	return util.Config{"queue": "fsm", "accessKey": "key", "secretKey": "secret", "region": "us-east-1"}
+}
+
+func TestStopBeforeInit(t *testing.T) {
+	(&Factory{}).Stop()
+}
+
+func TestVisibilityTimeout(t *testing.T) {
+	f := &Factory{}
+	if err := f.InitMQ(config()); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	if f.visibilityTimeout != defaultVisibilityTimeout {
+		t.Errorf("visibility timeout should default to %d, got %d", defaultVisibilityTimeout, f.visibilityTimeout)
+	}
+
+	c := config()
+	c["visibilityTimeout"] = int64(1)
+	if err := (&Factory{}).InitMQ(c); err == nil {
+		t.Error("visibilityTimeout 1 should be rejected")
+	}
+}
+
+// fakeSQS Serves a batch of two messages, then empty receives, and records the renewed receipt handles
+func fakeSQS(t *testing.T) (*httptest.Server, func() []string) {
+	var (
+		mu       sync.Mutex
+		received bool
+		renewed  []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&input)
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Header.Get("X-Amz-Target") {
+		case "AmazonSQS.ReceiveMessage":
+			if received {
+				time.Sleep(50 * time.Millisecond)
+				_, _ = w.Write([]byte(`{}`))
+				return
+			}
+			received = true
+			var messages []map[string]string
+			for _, id := range []string{"1", "2"} {
+				body := "task" + id
+				messages = append(messages, map[string]string{
+					"MessageId": id, "ReceiptHandle": "r" + id, "Body": body, "MD5OfBody": fmt.Sprintf("%x", md5.Sum([]byte(body))),
+				})
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"Messages": messages})
+		case "AmazonSQS.ChangeMessageVisibility":
+			renewed = append(renewed, input["ReceiptHandle"].(string))
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), renewed...)
+	}
+}
+
+func TestRenewWholeBatch(t *testing.T) {
+	server, renewed := fakeSQS(t)
+	c := config()
+	c["visibilityTimeout"] = int64(2)
+	f := &Factory{}
+	if err := f.InitMQ(c); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("key", "secret", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.sqs = sqs.New(sess)
+	f.Start()
+	defer f.Stop()
+
+	time.Sleep(1500 * time.Millisecond) // Nothing fetched, both messages wait locally
+	handles := renewed()
+	if !slices.Contains(handles, "r1") || !slices.Contains(handles, "r2") {
+		t.Errorf("every message of the batch should be renewed, got %v", handles)
+	}
+}
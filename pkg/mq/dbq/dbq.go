@@ -0,0 +1,211 @@
+package dbq
+
+import (
+	"context"
+	"fmt"
+	"github.com/HEUDavid/go-fsm/pkg/db"
+	"github.com/HEUDavid/go-fsm/pkg/mq"
+	"github.com/HEUDavid/go-fsm/pkg/util"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
+	"time"
+)
+
+// Queue is a message row of the queue table
+type Queue struct {
+	ID           uint64    `gorm:"primaryKey;autoIncrement;column:id"`
+	Body         string    `gorm:"column:body;type:text;not null;comment:'消息内容'"`                                     // 消息内容
+	VisibleTime  time.Time `gorm:"index:idx_visible_time;column:visible_time;type:timestamp;not null;comment:'可见时间'"` // 可见时间
+	Lease        string    `gorm:"column:lease;type:char(32);not null;default:'';comment:'租约, 每次投递重新生成'"`             // 租约, 每次投递重新生成
+	ReceiveCount uint      `gorm:"column:receive_count;size:32;not null;default:0;comment:'投递次数'"`                    // 投递次数
+	CreateTime   time.Time `gorm:"column:create_time;type:timestamp;not null;default:CURRENT_TIMESTAMP"`
+}
+
+func (q *Queue) TableName() string {
+	return "fsm_queue"
+}
+
+// Factory uses a table of the task database as the queue, no message broker is needed.
+// The task message is enqueued within the task transaction (see mq.ITxMQ), so it is never lost nor orphaned.
+// Messages are claimed by `SELECT ... FOR UPDATE SKIP LOCKED`, and stay invisible to others while
+// their lease is renewed, a crashed consumer's messages are visible again after VisibilityTimeout.
+// Config: table (default fsm_queue), visibilityTimeout (seconds, default 30), pollInterval (milliseconds, default 200), batchSize (default 10)
+type Factory struct {
+	Section           string
+	DB                db.IDB // The task database, initialized before InitMQ
+	table             string
+	visibilityTimeout time.Duration
+	pollInterval      time.Duration
+	batchSize         int
+	buffer            chan *mq.Message
+	ctx               context.Context // Done when stopped
+	stop              context.CancelFunc
+}
+
+func (f *Factory) GetMQSection() string {
+	return f.Section
+}
+
+func (f *Factory) InitMQ(config util.Config) error {
+	if f.DB == nil {
+		return fmt.Errorf("dbq DB not set")
+	}
+
+	f.table = (&Queue{}).TableName()
+	if table, ok := config["table"].(string); ok {
+		f.table = table
+	}
+	f.visibilityTimeout = 30 * time.Second
+	if timeout, ok := config["visibilityTimeout"].(int64); ok {
+		if timeout < 2 {
+			return fmt.Errorf("dbq visibilityTimeout should be at least 2 seconds")
+		}
+		f.visibilityTimeout = time.Duration(timeout) * time.Second
+	}
+	f.pollInterval = 200 * time.Millisecond
+	if interval, ok := config["pollInterval"].(int64); ok {
+		f.pollInterval = time.Duration(interval) * time.Millisecond
+	}
+	f.batchSize = 10
+	if batchSize, ok := config["batchSize"].(int64); ok {
+		f.batchSize = int(batchSize)
+	}
+
+	f.buffer = make(chan *mq.Message)
+	f.ctx, f.stop = context.WithCancel(context.Background())
+
+	return nil
+}
+
+func (f *Factory) PublishMessage(c context.Context, msg string) error {
+	return f.PublishMessageTx(c, f.DB.GetDB(), msg)
+}
+
+// PublishMessageTx Enqueues within the task transaction
+func (f *Factory) PublishMessageTx(c context.Context, tx *gorm.DB, msg string) error {
+	return f.publish(tx, msg, 0)
+}
+
+func (f *Factory) PublishDelayMessage(c context.Context, msg string, delay time.Duration) error {
+	return f.publish(f.DB.GetDB(), msg, delay)
+}
+
+func (f *Factory) publish(tx *gorm.DB, msg string, delay time.Duration) error {
+	return tx.Table(f.table).Create(&Queue{Body: msg, VisibleTime: time.Now().Add(delay)}).Error
+}
+
+func (f *Factory) FetchMessage(c context.Context) mq.Message {
+	select {
+	case msg := <-f.buffer:
+		return *msg
+	case <-c.Done():
+	case <-f.ctx.Done():
+	}
+	return mq.Message{C: c}
+}
+
+func (f *Factory) Start() {
+	go func() {
+		for f.ctx.Err() == nil {
+			messages, err := f.claim()
+			if err != nil {
+				log.Printf("[FSM] dbq claiming message Err: %v", err)
+			}
+			leases := make([]*mq.Lease, len(messages))
+			for i, msg := range messages { // Renewed at once, the rest of the batch waits for the buffer
+				leases[i] = f.lease(msg)
+			}
+			for i, msg := range messages {
+				f.deliver(msg, leases[i])
+			}
+			if err != nil || len(messages) < f.batchSize { // Drained, otherwise go on at once
+				select {
+				case <-time.After(f.pollInterval):
+				case <-f.ctx.Done():
+				}
+			}
+		}
+	}()
+}
+
+func (f *Factory) Stop() {
+	f.stop()
+}
+
+// claim Leases a batch of visible messages
+func (f *Factory) claim() ([]Queue, error) {
+	var messages []Queue
+	err := f.DB.GetDB().Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if e := tx.Table(f.table).Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("visible_time <= ?", now).Order("id").Limit(f.batchSize).Find(&messages).Error; e != nil {
+			return e
+		}
+		for i := range messages {
+			messages[i].Lease = util.UniqueID()
+			messages[i].ReceiveCount++
+			if e := tx.Table(f.table).Where("id = ?", messages[i].ID).Updates(map[string]interface{}{
+				"visible_time":  now.Add(f.visibilityTimeout),
+				"lease":         messages[i].Lease,
+				"receive_count": messages[i].ReceiveCount,
+			}).Error; e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// lease Renews the lease of the message until it is acked or nacked
+func (f *Factory) lease(queue Queue) *mq.Lease {
+	return mq.NewLease(context.Background(), f.visibilityTimeout/2, func() bool { return f.renew(queue) })
+}
+
+// deliver Hands the message to FetchMessage
+func (f *Factory) deliver(queue Queue, lease *mq.Lease) {
+	settle := func(update func(tx *gorm.DB) *gorm.DB) error {
+		return lease.Settle(func() error {
+			result := update(f.DB.GetDB().Table(f.table).Where("id = ? and lease = ?", queue.ID, queue.Lease))
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected <= 0 {
+				return fmt.Errorf("lease of message %d lost", queue.ID)
+			}
+			return nil
+		}, fmt.Errorf("message %d already settled", queue.ID))
+	}
+
+	lease.Deliver(f.ctx, f.buffer, &mq.Message{ // Visible again after the visibility timeout if stopped
+		C:    context.Background(),
+		Body: queue.Body,
+		Ack: func() error {
+			return settle(func(tx *gorm.DB) *gorm.DB { return tx.Delete(&Queue{}) })
+		},
+		Nack: func() error {
+			return settle(func(tx *gorm.DB) *gorm.DB {
+				return tx.Updates(map[string]interface{}{"visible_time": time.Now(), "lease": ""})
+			})
+		},
+	})
+}
+
+// renew Extends the lease of the message, false once it is lost
+func (f *Factory) renew(queue Queue) bool {
+	result := f.DB.GetDB().Table(f.table).Where("id = ? and lease = ?", queue.ID, queue.Lease).
+		Update("visible_time", time.Now().Add(f.visibilityTimeout))
+	if result.Error != nil {
+		log.Printf("[FSM] dbq renewing lease of message %d Err: %v", queue.ID, result.Error)
+		return true
+	}
+	if result.RowsAffected <= 0 {
+		log.Printf("[FSM] dbq lease of message %d lost", queue.ID)
+		return false
+	}
+	return true
+}
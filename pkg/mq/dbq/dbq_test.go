@@ -0,0 +1,160 @@
+package dbq
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/HEUDavid/go-fsm/pkg/db/sqlite"
+	"github.com/HEUDavid/go-fsm/pkg/util"
+	"gorm.io/gorm"
+)
+
+func newFactory(t *testing.T, config util.Config) *Factory {
+	database := &sqlite.Factory{Section: "sqlite"}
+	if err := database.InitDB(util.Config{"path": filepath.Join(t.TempDir(), "fsm.db")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.GetDB().AutoMigrate(&Queue{}); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &Factory{Section: "dbq", DB: database}
+	if err := f.InitMQ(config); err != nil {
+		t.Fatal(err)
+	}
+	f.Start()
+	t.Cleanup(func() {
+		f.Stop()
+		_ = database.CloseDB()
+	})
+	return f
+}
+
+func fetch(t *testing.T, f *Factory) (string, func() error, func() error) {
+	c, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	msg := f.FetchMessage(c)
+	if msg.Body == "" {
+		t.Fatal("no message fetched")
+	}
+	return msg.Body, msg.Ack, msg.Nack
+}
+
+func count(t *testing.T, f *Factory) int64 {
+	var n int64
+	if err := f.DB.GetDB().Table(f.table).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestAckAndNack(t *testing.T) {
+	c := context.Background()
+	f := newFactory(t, util.Config{"pollInterval": int64(10)})
+
+	_ = f.PublishMessage(c, "task1")
+	_ = f.PublishMessage(c, "task2")
+
+	body, ack, nack := fetch(t, f)
+	if body != "task1" {
+		t.Fatalf("unexpected message: %s", body)
+	}
+	if err := nack(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ack(); err == nil {
+		t.Error("ack after nack should fail")
+	}
+
+	for _, want := range []string{"task2", "task1"} {
+		body, ack, _ = fetch(t, f)
+		if body != want {
+			t.Errorf("unexpected message: %s, want %s", body, want)
+		}
+		if err := ack(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := count(t, f); n != 0 {
+		t.Errorf("acked messages should be deleted, %d left", n)
+	}
+}
+
+func TestPublishInTransaction(t *testing.T) {
+	c := context.Background()
+	f := newFactory(t, util.Config{"pollInterval": int64(10)})
+
+	_ = f.DB.GetDB().Transaction(func(tx *gorm.DB) error {
+		_ = f.PublishMessageTx(c, tx, "rolled back")
+		return gorm.ErrInvalidTransaction
+	})
+	_ = f.DB.GetDB().Transaction(func(tx *gorm.DB) error {
+		return f.PublishMessageTx(c, tx, "committed")
+	})
+
+	body, ack, _ := fetch(t, f)
+	if body != "committed" {
+		t.Errorf("unexpected message: %s", body)
+	}
+	_ = ack()
+	if n := count(t, f); n != 0 {
+		t.Errorf("rolled back message should not be enqueued, %d left", n)
+	}
+}
+
+func TestDelayAndVisibilityTimeout(t *testing.T) {
+	c := context.Background()
+	f := newFactory(t, util.Config{"pollInterval": int64(10), "visibilityTimeout": int64(2)})
+
+	start := time.Now()
+	_ = f.PublishDelayMessage(c, "task1", 200*time.Millisecond)
+	body, ack, _ := fetch(t, f) // Never acked, lease renewal is stopped by losing it below
+	if body != "task1" || time.Since(start) < 200*time.Millisecond {
+		t.Fatalf("unexpected delivery: %s after %s", body, time.Since(start))
+	}
+
+	// Simulate a dead consumer whose lease has expired
+	if err := f.DB.GetDB().Table(f.table).Where("body = ?", "task1").
+		Update("visible_time", time.Now()).Error; err != nil {
+		t.Fatal(err)
+	}
+	body, ack2, _ := fetch(t, f)
+	if body != "task1" {
+		t.Errorf("unexpected message: %s", body)
+	}
+	if err := ack(); err == nil {
+		t.Error("ack with a lost lease should fail")
+	}
+	if err := ack2(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInitMQVisibilityTimeout(t *testing.T) {
+	f := &Factory{DB: &sqlite.Factory{}}
+	if err := f.InitMQ(util.Config{"visibilityTimeout": int64(1)}); err == nil {
+		t.Error("visibilityTimeout 1 should be rejected")
+	}
+}
+
+func TestRenewWholeBatch(t *testing.T) {
+	c := context.Background()
+	f := newFactory(t, util.Config{"pollInterval": int64(10), "visibilityTimeout": int64(2), "batchSize": int64(2)})
+
+	start := time.Now()
+	_ = f.PublishMessage(c, "task1")
+	_ = f.PublishMessage(c, "task2")
+	time.Sleep(1500 * time.Millisecond) // Nothing fetched, both messages wait locally
+
+	var visible []time.Time
+	if err := f.DB.GetDB().Table(f.table).Order("id").Pluck("visible_time", &visible).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range visible {
+		if v.Before(start.Add(2500 * time.Millisecond)) {
+			t.Errorf("message %d should be renewed, visible at %s", i+1, v.Sub(start))
+		}
+	}
+}
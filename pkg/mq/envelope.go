@@ -0,0 +1,48 @@
+package mq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Envelope is the Message.Body of a task, encoded as JSON.
+// The expected State and Version let the worker drop stale messages, FSM and Type let FSMs share a queue.
+type Envelope struct {
+	TaskID      string            `json:"taskID"`
+	FSM         string            `json:"fsm,omitempty"`
+	Type        string            `json:"type,omitempty"`
+	State       string            `json:"state,omitempty"`   // The state of the task when published
+	Version     uint              `json:"version,omitempty"` // The version of the task when published, 0 means unknown
+	Headers     map[string]string `json:"headers,omitempty"` // Trace context, see Propagator
+	Attempt     uint              `json:"attempt,omitempty"`
+	EnqueueTime time.Time         `json:"enqueueTime"`
+}
+
+func (e *Envelope) Encode() string {
+	b, _ := json.Marshal(e)
+	return string(b)
+}
+
+// DecodeEnvelope Decodes a message body, a bare task ID published by older versions is accepted as well
+func DecodeEnvelope(body string) (*Envelope, error) {
+	if !strings.HasPrefix(body, "{") {
+		return &Envelope{TaskID: body}, nil
+	}
+	e := &Envelope{}
+	if err := json.Unmarshal([]byte(body), e); err != nil {
+		return nil, fmt.Errorf("decode envelope: %w", err)
+	}
+	if e.TaskID == "" {
+		return nil, fmt.Errorf("decode envelope: taskID empty")
+	}
+	return e, nil
+}
+
+// Propagator carries the trace context across the MQ, e.g. an adapter of OpenTelemetry's TextMapPropagator
+type Propagator interface {
+	Inject(c context.Context, headers map[string]string)
+	Extract(c context.Context, headers map[string]string) context.Context
+}
@@ -0,0 +1,32 @@
+package mq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnvelope(t *testing.T) {
+	e := &Envelope{
+		TaskID:      "task1",
+		FSM:         "PayFSM",
+		State:       "Pay",
+		Version:     2,
+		Headers:     map[string]string{"traceparent": "00-abc-def-01"},
+		EnqueueTime: time.UnixMilli(1700000000000).UTC(),
+	}
+	decoded, err := DecodeEnvelope(e.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.TaskID != e.TaskID || decoded.FSM != e.FSM || decoded.State != e.State || decoded.Version != e.Version ||
+		decoded.Headers["traceparent"] != e.Headers["traceparent"] || !decoded.EnqueueTime.Equal(e.EnqueueTime) {
+		t.Errorf("unexpected envelope: %+v", decoded)
+	}
+
+	if decoded, err = DecodeEnvelope("task1"); err != nil || decoded.TaskID != "task1" || decoded.State != "" {
+		t.Errorf("bare task ID should be accepted: %+v, %v", decoded, err)
+	}
+	if _, err = DecodeEnvelope(`{"fsm": "PayFSM"}`); err == nil {
+		t.Error("envelope without taskID should be rejected")
+	}
+}
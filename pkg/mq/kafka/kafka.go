@@ -0,0 +1,329 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/HEUDavid/go-fsm/pkg/mq"
+	"github.com/HEUDavid/go-fsm/pkg/util"
+	"github.com/segmentio/kafka-go"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const deliverAtHeader = "fsm-deliver-at" // Unix milliseconds, the delayed message is forwarded to the topic then
+
+// DefaultDelayBuckets The delays of the delay topics in ascending order
+var DefaultDelayBuckets = []time.Duration{
+	time.Second, 5 * time.Second, 30 * time.Second, time.Minute, 5 * time.Minute, 30 * time.Minute, time.Hour,
+}
+
+// Factory Kafka consumer group, messages are keyed by task ID so all events of a task stay on one partition.
+// Offsets are committed on Ack, in order per partition, so a crash redelivers the unacked messages.
+//
+// Kafka has no delayed delivery, a delayed message is published to the delay topic "<topic>.delay.<ms>"
+// of the smallest bucket not shorter than the delay (capped to the largest bucket), and forwarded to the topic
+// when due by the consumers started with Start. All messages of a delay topic share the bucket delay, so a short
+// delay never waits behind a longer one. The delay topics should exist, or the broker should auto create them.
+// Nack publishes the message again with nackDelay.
+//
+// Config: brokers (array or comma separated), topic, groupID, nackDelay (default "1s")
+type Factory struct {
+	Section      string
+	DelayBuckets []time.Duration // Defaults to DefaultDelayBuckets
+	NackDelay    time.Duration
+
+	buffer  chan *mq.Message
+	brokers []string
+	topic   string
+	groupID string
+	writer  writer
+	readers []reader
+	ctx     context.Context // Done when stopped
+	stop    context.CancelFunc
+
+	newReader func(topic, groupID string) reader // Replaced in tests
+
+	mu         sync.Mutex
+	partitions map[int]*partition
+}
+
+type reader interface {
+	FetchMessage(c context.Context) (kafka.Message, error)
+	CommitMessages(c context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+type writer interface {
+	WriteMessages(c context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// partition Tracks the fetched offsets of a partition, only the acked prefix is committed
+type partition struct {
+	offsets []int64        // Fetched and not committed, ascending
+	acked   map[int64]bool // Offset -> whether acked
+	next    int64          // The offset expected to be fetched next
+}
+
+func (f *Factory) GetMQSection() string {
+	return f.Section
+}
+
+func (f *Factory) InitMQ(config util.Config) error {
+	switch brokers := config["brokers"].(type) {
+	case string:
+		f.brokers = strings.Split(brokers, ",")
+	case []interface{}:
+		for _, broker := range brokers {
+			f.brokers = append(f.brokers, broker.(string))
+		}
+	default:
+		return fmt.Errorf("kafka brokers not configured")
+	}
+	f.topic = config["topic"].(string)
+	f.groupID = config["groupID"].(string)
+
+	f.NackDelay = time.Second
+	if nackDelay, ok := config["nackDelay"].(string); ok {
+		d, err := time.ParseDuration(nackDelay)
+		if err != nil {
+			return fmt.Errorf("kafka nackDelay: %w", err)
+		}
+		f.NackDelay = d
+	}
+	if len(f.DelayBuckets) == 0 {
+		f.DelayBuckets = DefaultDelayBuckets
+	}
+
+	f.writer = &kafka.Writer{
+		Addr:         kafka.TCP(f.brokers...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+	}
+	f.newReader = func(topic, groupID string) reader {
+		return kafka.NewReader(kafka.ReaderConfig{Brokers: f.brokers, GroupID: groupID, Topic: topic})
+	}
+	f.init()
+	return nil
+}
+
+func (f *Factory) init() {
+	f.buffer = make(chan *mq.Message)
+	f.partitions = map[int]*partition{}
+	f.ctx, f.stop = context.WithCancel(context.Background())
+}
+
+func (f *Factory) PublishMessage(c context.Context, msg string) error {
+	return f.writer.WriteMessages(c, kafka.Message{Topic: f.topic, Key: key(msg), Value: []byte(msg)})
+}
+
+// PublishDelayMessage Publishes to the delay topic of the bucket of delay, see Factory
+func (f *Factory) PublishDelayMessage(c context.Context, msg string, delay time.Duration) error {
+	return f.publishDelay(c, key(msg), []byte(msg), delay)
+}
+
+func (f *Factory) publishDelay(c context.Context, key, value []byte, delay time.Duration) error {
+	deliverAt := strconv.FormatInt(time.Now().Add(delay).UnixMilli(), 10)
+	return f.writer.WriteMessages(c, kafka.Message{
+		Topic:   f.delayTopic(f.delayBucket(delay)),
+		Key:     key,
+		Value:   value,
+		Headers: []kafka.Header{{Key: deliverAtHeader, Value: []byte(deliverAt)}},
+	})
+}
+
+func (f *Factory) FetchMessage(c context.Context) mq.Message {
+	select {
+	case msg := <-f.buffer:
+		return *msg
+	case <-c.Done():
+	case <-f.ctx.Done():
+	}
+	return mq.Message{C: c}
+}
+
+func (f *Factory) Start() {
+	r := f.newReader(f.topic, f.groupID)
+	f.readers = append(f.readers, r)
+	go f.consume(r)
+
+	for _, bucket := range f.DelayBuckets {
+		r = f.newReader(f.delayTopic(bucket), f.groupID+".delay")
+		f.readers = append(f.readers, r)
+		go f.forward(r)
+	}
+}
+
+func (f *Factory) Stop() {
+	if f.stop == nil { // Not initialized
+		return
+	}
+	f.stop()
+	for _, r := range f.readers {
+		_ = r.Close()
+	}
+	_ = f.writer.Close()
+}
+
+func (f *Factory) consume(r reader) {
+	for {
+		message, err := f.fetch(r)
+		if err != nil {
+			return // Stopped
+		}
+		f.track(message)
+
+		select {
+		case f.buffer <- f.genMessage(r, message):
+		case <-f.ctx.Done(): // Not committed, redelivered after restart
+			return
+		}
+	}
+}
+
+// forward Moves the messages of a delay topic to the topic when due, one at a time.
+// They are due in about the order of their offsets, all of them having the delay of the bucket.
+func (f *Factory) forward(r reader) {
+	for {
+		message, err := f.fetch(r)
+		if err != nil {
+			return // Stopped
+		}
+
+		if delay := time.Until(deliverAt(message)); delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-f.ctx.Done(): // Not committed, forwarded after restart
+				return
+			}
+		}
+		for {
+			err = f.writer.WriteMessages(f.ctx, kafka.Message{Topic: f.topic, Key: message.Key, Value: message.Value})
+			if err == nil {
+				err = r.CommitMessages(f.ctx, message)
+			}
+			if err == nil || f.ctx.Err() != nil {
+				break
+			}
+			log.Printf("[FSM] kafka forwarding delayed message Err: %v", err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// fetch Retries until a message is fetched, returns an error only when stopped
+func (f *Factory) fetch(r reader) (kafka.Message, error) {
+	for {
+		message, err := r.FetchMessage(f.ctx)
+		if err == nil {
+			return message, nil
+		}
+		if f.ctx.Err() != nil || errors.Is(err, io.EOF) {
+			return message, err
+		}
+		log.Printf("[FSM] kafka fetching message Err: %v", err)
+		time.Sleep(time.Second)
+	}
+}
+
+func (f *Factory) genMessage(r reader, message kafka.Message) *mq.Message {
+	return &mq.Message{
+		C:    context.Background(),
+		Body: string(message.Value),
+		Ack: func() error {
+			return f.ack(r, message)
+		},
+		Nack: func() error {
+			if err := f.publishDelay(context.Background(), message.Key, message.Value, f.NackDelay); err != nil {
+				return fmt.Errorf("error republish message: %w", err)
+			}
+			return f.ack(r, message)
+		},
+	}
+}
+
+// track Records the fetched offset. The reader fetches a partition in order, a smaller offset than expected
+// means the partition was assigned again (a rebalance), from its committed offset, so its tracking restarts.
+func (f *Factory) track(message kafka.Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.partitions[message.Partition]
+	if !ok || message.Offset < p.next {
+		p = &partition{acked: map[int64]bool{}}
+		f.partitions[message.Partition] = p
+	}
+	p.next = message.Offset + 1
+	p.acked[message.Offset] = false
+	p.offsets = append(p.offsets, message.Offset)
+	sort.Slice(p.offsets, func(i, j int) bool { return p.offsets[i] < p.offsets[j] })
+}
+
+// ack Commits the largest offset whose preceding offsets are all acked
+func (f *Factory) ack(r reader, message kafka.Message) error {
+	f.mu.Lock()
+	p, ok := f.partitions[message.Partition]
+	if !ok {
+		f.mu.Unlock()
+		return fmt.Errorf("unknown partition %d", message.Partition)
+	}
+	if _, ok = p.acked[message.Offset]; !ok { // Committed already, or tracked before a rebalance
+		f.mu.Unlock()
+		return nil
+	}
+	p.acked[message.Offset] = true
+	commit := int64(-1)
+	for len(p.offsets) > 0 && p.acked[p.offsets[0]] {
+		commit = p.offsets[0]
+		delete(p.acked, commit)
+		p.offsets = p.offsets[1:]
+	}
+	f.mu.Unlock()
+
+	if commit < 0 {
+		return nil
+	}
+	return r.CommitMessages(context.Background(), kafka.Message{
+		Topic:     message.Topic,
+		Partition: message.Partition,
+		Offset:    commit,
+	})
+}
+
+func (f *Factory) delayTopic(bucket time.Duration) string {
+	return f.topic + ".delay." + strconv.FormatInt(bucket.Milliseconds(), 10)
+}
+
+func (f *Factory) delayBucket(delay time.Duration) time.Duration {
+	for _, bucket := range f.DelayBuckets {
+		if bucket >= delay {
+			return bucket
+		}
+	}
+	return f.DelayBuckets[len(f.DelayBuckets)-1]
+}
+
+// key The task ID of the message envelope
+func key(msg string) []byte {
+	if envelope, err := mq.DecodeEnvelope(msg); err == nil {
+		return []byte(envelope.TaskID)
+	}
+	return []byte(msg)
+}
+
+func deliverAt(message kafka.Message) time.Time {
+	for _, header := range message.Headers {
+		if header.Key != deliverAtHeader {
+			continue
+		}
+		if ms, err := strconv.ParseInt(string(header.Value), 10, 64); err == nil {
+			return time.UnixMilli(ms)
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,178 @@
+package kafka
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/HEUDavid/go-fsm/pkg/mq"
+	"github.com/segmentio/kafka-go"
+)
+
+// broker An in-memory broker of single partition topics
+type broker struct {
+	mu       sync.Mutex
+	topics   map[string][]kafka.Message
+	commits  map[string][]int64 // Topic -> committed offsets
+	appended chan struct{}
+}
+
+func newBroker() *broker {
+	return &broker{topics: map[string][]kafka.Message{}, commits: map[string][]int64{}, appended: make(chan struct{})}
+}
+
+func (b *broker) WriteMessages(c context.Context, msgs ...kafka.Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, msg := range msgs {
+		msg.Offset = int64(len(b.topics[msg.Topic]))
+		b.topics[msg.Topic] = append(b.topics[msg.Topic], msg)
+	}
+	close(b.appended)
+	b.appended = make(chan struct{})
+	return nil
+}
+
+func (b *broker) Close() error { return nil }
+
+func (b *broker) committed(topic string) []int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]int64(nil), b.commits[topic]...)
+}
+
+type testReader struct {
+	*broker
+	topic string
+	next  int
+}
+
+func (r *testReader) FetchMessage(c context.Context) (kafka.Message, error) {
+	for {
+		r.mu.Lock()
+		if r.next < len(r.topics[r.topic]) {
+			msg := r.topics[r.topic][r.next]
+			r.next++
+			r.mu.Unlock()
+			return msg, nil
+		}
+		appended := r.appended
+		r.mu.Unlock()
+
+		select {
+		case <-appended:
+		case <-c.Done():
+			return kafka.Message{}, c.Err()
+		}
+	}
+}
+
+func (r *testReader) CommitMessages(c context.Context, msgs ...kafka.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, msg := range msgs {
+		r.commits[r.topic] = append(r.commits[r.topic], msg.Offset)
+	}
+	return nil
+}
+
+func newFactory(t *testing.T, b *broker) *Factory {
+	f := &Factory{topic: "fsm", groupID: "worker", writer: b, NackDelay: 10 * time.Millisecond}
+	f.DelayBuckets = []time.Duration{10 * time.Millisecond, 50 * time.Millisecond}
+	f.newReader = func(topic, groupID string) reader { return &testReader{broker: b, topic: topic} }
+	f.init()
+	f.Start()
+	t.Cleanup(f.Stop)
+	return f
+}
+
+func TestAckCommitsInOrder(t *testing.T) {
+	b := newBroker()
+	f := newFactory(t, b)
+
+	c, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		_ = f.PublishMessage(c, "task"+strconv.Itoa(i))
+	}
+	var msgs []mq.Message
+	for i := 0; i < 3; i++ {
+		msgs = append(msgs, f.FetchMessage(c))
+	}
+
+	_ = msgs[1].Ack()
+	if committed := b.committed("fsm"); len(committed) != 0 {
+		t.Errorf("offset 1 should wait for offset 0, committed %v", committed)
+	}
+	_ = msgs[0].Ack()
+	_ = msgs[2].Ack()
+	if committed := b.committed("fsm"); len(committed) != 2 || committed[0] != 1 || committed[1] != 2 {
+		t.Errorf("unexpected commits %v", committed)
+	}
+}
+
+func TestTrackAfterRebalance(t *testing.T) {
+	f := &Factory{}
+	f.init()
+	r := &testReader{broker: newBroker(), topic: "fsm"}
+	for _, offset := range []int64{5, 6, 5} { // Offset 5 is fetched again after a rebalance
+		f.track(kafka.Message{Topic: "fsm", Offset: offset})
+	}
+	if p := f.partitions[0]; len(p.offsets) != 1 || p.offsets[0] != 5 {
+		t.Fatalf("unexpected tracking %+v", p)
+	}
+	_ = f.ack(r, kafka.Message{Topic: "fsm", Offset: 6}) // Delivered before the rebalance
+	_ = f.ack(r, kafka.Message{Topic: "fsm", Offset: 5})
+	if committed := r.committed("fsm"); len(committed) != 1 || committed[0] != 5 {
+		t.Errorf("unexpected commits %v", committed)
+	}
+}
+
+func TestDelayAndNack(t *testing.T) {
+	b := newBroker()
+	f := newFactory(t, b)
+
+	c, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	_ = f.PublishDelayMessage(c, "task1", 30*time.Millisecond)
+	b.mu.Lock()
+	delayed := len(b.topics["fsm.delay.50"])
+	b.mu.Unlock()
+	if delayed != 1 {
+		t.Fatal("delayed message should be published to the delay topic of its bucket")
+	}
+	msg := f.FetchMessage(c)
+	if msg.Body != "task1" || time.Since(start) < 29*time.Millisecond {
+		t.Fatalf("unexpected message %s after %s", msg.Body, time.Since(start))
+	}
+
+	start = time.Now()
+	if err := msg.Nack(); err != nil {
+		t.Fatal(err)
+	}
+	// deliverAt is in milliseconds
+	if msg = f.FetchMessage(c); msg.Body != "task1" || time.Since(start) < 9*time.Millisecond {
+		t.Errorf("unexpected message %s after %s", msg.Body, time.Since(start))
+	}
+	for len(b.committed("fsm.delay.10")) != 1 { // Committed right after forwarding
+		select {
+		case <-c.Done():
+			t.Fatal("the forwarded message should be committed")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestDeliverAt(t *testing.T) {
+	at := time.UnixMilli(time.Now().UnixMilli())
+	message := kafka.Message{Headers: []kafka.Header{{Key: deliverAtHeader, Value: []byte(strconv.FormatInt(at.UnixMilli(), 10))}}}
+	if !deliverAt(message).Equal(at) {
+		t.Errorf("unexpected deliverAt %s", deliverAt(message))
+	}
+	if !deliverAt(kafka.Message{}).IsZero() {
+		t.Error("deliverAt without header should be zero")
+	}
+}
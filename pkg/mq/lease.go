@@ -0,0 +1,65 @@
+package mq
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Lease keeps a received message from being redelivered while it waits in the buffer and is being handled,
+// renew is called every interval until the message is settled, ctx is done, or renew returns false
+// (e.g. the message is reclaimed by another consumer).
+type Lease struct {
+	once    sync.Once
+	settled chan struct{}
+}
+
+// NewLease Starts renewing the message at once, interval should be less than the lease of the queue
+func NewLease(ctx context.Context, interval time.Duration, renew func() bool) *Lease {
+	l := &Lease{settled: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-l.settled:
+				return
+			case <-ctx.Done():
+				return
+			}
+			if !renew() {
+				return
+			}
+		}
+	}()
+	return l
+}
+
+// Settle Stops the renewal and runs settle, only the first call runs it, later calls return already
+func (l *Lease) Settle(settle func() error, already error) error {
+	err := already
+	l.once.Do(func() {
+		close(l.settled)
+		err = settle()
+	})
+	return err
+}
+
+// Release Stops the renewal without settling the message, it is redelivered once its lease expires
+func (l *Lease) Release() {
+	l.once.Do(func() {
+		close(l.settled)
+	})
+}
+
+// Deliver Hands msg to FetchMessage through buffer, the lease is released if ctx is done first
+func (l *Lease) Deliver(ctx context.Context, buffer chan<- *Message, msg *Message) bool {
+	select {
+	case buffer <- msg:
+		return true
+	case <-ctx.Done():
+		l.Release()
+		return false
+	}
+}
@@ -0,0 +1,69 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLeaseRenewUntilSettled(t *testing.T) {
+	var renewed atomic.Int32
+	l := NewLease(context.Background(), 10*time.Millisecond, func() bool {
+		renewed.Add(1)
+		return true
+	})
+	time.Sleep(55 * time.Millisecond)
+
+	already := errors.New("already settled")
+	var settled int
+	for i := 0; i < 2; i++ {
+		if err := l.Settle(func() error { settled++; return nil }, already); (err == nil) != (i == 0) {
+			t.Errorf("unexpected settle %d: %v", i, err)
+		}
+	}
+	n := renewed.Load()
+	time.Sleep(30 * time.Millisecond)
+	if n < 3 || renewed.Load() != n || settled != 1 {
+		t.Errorf("expected renewals until settled once, got %d then %d, settled %d", n, renewed.Load(), settled)
+	}
+}
+
+func TestLeaseRenewLost(t *testing.T) {
+	var renewed atomic.Int32
+	NewLease(context.Background(), 10*time.Millisecond, func() bool {
+		renewed.Add(1)
+		return false // Reclaimed by another consumer
+	})
+	time.Sleep(50 * time.Millisecond)
+	if n := renewed.Load(); n != 1 {
+		t.Errorf("renewal should end once lost, renewed %d times", n)
+	}
+}
+
+func TestLeaseDeliver(t *testing.T) {
+	buffer := make(chan *Message, 1)
+	var renewed atomic.Int32
+	l := NewLease(context.Background(), 10*time.Millisecond, func() bool {
+		renewed.Add(1)
+		return true
+	})
+	if !l.Deliver(context.Background(), buffer, &Message{Body: "task1"}) || (<-buffer).Body != "task1" {
+		t.Fatal("message should be delivered")
+	}
+
+	c, cancel := context.WithCancel(context.Background())
+	cancel()
+	if l.Deliver(c, make(chan *Message), &Message{Body: "task2"}) { // Nobody is fetching
+		t.Fatal("message should not be delivered after stop")
+	}
+	n := renewed.Load()
+	time.Sleep(30 * time.Millisecond)
+	if renewed.Load() != n {
+		t.Error("lease should be released when not delivered")
+	}
+	if err := l.Settle(func() error { return nil }, errors.New("already settled")); err == nil {
+		t.Error("released lease should not be settled")
+	}
+}
@@ -0,0 +1,256 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"github.com/HEUDavid/go-fsm/pkg/mq"
+	"github.com/HEUDavid/go-fsm/pkg/util"
+	"sync"
+	"time"
+)
+
+// Factory is an in-process queue with ack, nack and redelivery, for tests and single-process deployments.
+// Messages are lost when the process exits.
+// Config: visibilityTimeout (seconds, unacked messages are redelivered after it, 0 means never)
+type Factory struct {
+	Section           string
+	VisibilityTimeout time.Duration
+	RecordPublished   bool // Keeps every published message for Published, for tests only
+
+	once      sync.Once
+	mu        sync.Mutex
+	ready     []*message
+	inflight  map[uint64]*message
+	delayed   int
+	published []string
+	stats     Stats
+	seq       uint64
+	signal    chan struct{} // Closed and replaced when a message gets ready
+	done      chan struct{} // Closed when stopped
+}
+
+type message struct {
+	body     string
+	delivery uint64 // Sequence of the current delivery
+	timer    *time.Timer
+}
+
+// Stats Counters since the first InitMQ
+type Stats struct {
+	Published   int // Including delayed ones
+	Delivered   int // Including redeliveries
+	Acked       int
+	Nacked      int
+	Redelivered int // By nack or visibility timeout
+}
+
+func (f *Factory) GetMQSection() string {
+	return f.Section
+}
+
+// InitMQ Only the first call takes effect, so that the Adapter and Worker of a process can share the queue
+func (f *Factory) InitMQ(config util.Config) error {
+	f.once.Do(func() {
+		if timeout, ok := config["visibilityTimeout"].(int64); ok {
+			f.VisibilityTimeout = time.Duration(timeout) * time.Second
+		}
+		f.init()
+	})
+	return nil
+}
+
+func (f *Factory) init() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inflight = map[uint64]*message{}
+	f.signal = make(chan struct{})
+	f.done = make(chan struct{})
+}
+
+func (f *Factory) PublishMessage(c context.Context, msg string) error {
+	f.once.Do(f.init)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stopped() {
+		return fmt.Errorf("memory queue stopped")
+	}
+	if f.RecordPublished {
+		f.published = append(f.published, msg)
+	}
+	f.stats.Published++
+	f.push(&message{body: msg})
+	return nil
+}
+
+func (f *Factory) PublishDelayMessage(c context.Context, msg string, delay time.Duration) error {
+	f.once.Do(f.init)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stopped() {
+		return fmt.Errorf("memory queue stopped")
+	}
+	if f.RecordPublished {
+		f.published = append(f.published, msg)
+	}
+	f.stats.Published++
+	f.delayed++
+	time.AfterFunc(delay, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.delayed--
+		f.push(&message{body: msg})
+	})
+	return nil
+}
+
+func (f *Factory) FetchMessage(c context.Context) mq.Message {
+	f.once.Do(f.init)
+	for {
+		f.mu.Lock()
+		if f.stopped() {
+			f.mu.Unlock()
+			return mq.Message{C: c}
+		}
+		if len(f.ready) > 0 {
+			msg := f.deliver()
+			f.mu.Unlock()
+			return msg
+		}
+		signal, done := f.signal, f.done
+		f.mu.Unlock()
+
+		select {
+		case <-signal:
+		case <-done:
+		case <-c.Done():
+			return mq.Message{C: c}
+		}
+	}
+}
+
+func (f *Factory) Start() {}
+
+// Stop Wakes up the blocked FetchMessage, messages not acked are dropped
+func (f *Factory) Stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done != nil && !f.stopped() { // Nothing to stop before InitMQ
+		close(f.done)
+	}
+}
+
+// Published All the messages published in order, requires RecordPublished
+func (f *Factory) Published() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.published...)
+}
+
+func (f *Factory) Stats() Stats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stats
+}
+
+// Len Messages ready, in-flight and delayed
+func (f *Factory) Len() (ready, inflight, delayed int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.ready), len(f.inflight), f.delayed
+}
+
+// WaitIdle Blocks until there are no ready, in-flight or delayed messages
+func (f *Factory) WaitIdle(c context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if ready, inflight, delayed := f.Len(); ready+inflight+delayed == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-c.Done():
+			return c.Err()
+		}
+	}
+}
+
+func (f *Factory) stopped() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// push Makes the message ready, f.mu must be held
+func (f *Factory) push(msg *message) {
+	if f.stopped() {
+		return
+	}
+	f.ready = append(f.ready, msg)
+	close(f.signal)
+	f.signal = make(chan struct{})
+}
+
+// deliver Moves the head message in flight, f.mu must be held
+func (f *Factory) deliver() mq.Message {
+	msg := f.ready[0]
+	f.ready = f.ready[1:]
+	f.seq++
+	delivery := f.seq
+	msg.delivery = delivery
+	f.inflight[delivery] = msg
+	f.stats.Delivered++
+
+	if f.VisibilityTimeout > 0 {
+		msg.timer = time.AfterFunc(f.VisibilityTimeout, func() {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if f.settle(delivery) {
+				f.stats.Redelivered++
+				f.push(msg)
+			}
+		})
+	}
+
+	return mq.Message{
+		C:    context.Background(),
+		Body: msg.body,
+		Ack: func() error {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if !f.settle(delivery) {
+				return fmt.Errorf("message %s already settled or redelivered", msg.body)
+			}
+			f.stats.Acked++
+			return nil
+		},
+		Nack: func() error {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if !f.settle(delivery) {
+				return fmt.Errorf("message %s already settled or redelivered", msg.body)
+			}
+			f.stats.Nacked++
+			f.stats.Redelivered++
+			f.push(msg)
+			return nil
+		},
+	}
+}
+
+// settle Removes the delivery from in-flight, false if it is not in flight anymore, f.mu must be held
+func (f *Factory) settle(delivery uint64) bool {
+	msg, ok := f.inflight[delivery]
+	if !ok {
+		return false
+	}
+	delete(f.inflight, delivery)
+	if msg.timer != nil {
+		msg.timer.Stop()
+		msg.timer = nil
+	}
+	return true
+}
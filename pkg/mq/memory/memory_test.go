@@ -0,0 +1,137 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/HEUDavid/go-fsm/pkg/util"
+)
+
+func newFactory(t *testing.T, config util.Config) *Factory {
+	f := &Factory{Section: "memory"}
+	if err := f.InitMQ(config); err != nil {
+		t.Fatal(err)
+	}
+	f.Start()
+	t.Cleanup(f.Stop)
+	return f
+}
+
+func fetch(t *testing.T, f *Factory) string {
+	c, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	msg := f.FetchMessage(c)
+	if msg.Body == "" {
+		t.Fatal("no message fetched")
+	}
+	if err := msg.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	return msg.Body
+}
+
+func TestAckAndNack(t *testing.T) {
+	c := context.Background()
+	f := newFactory(t, nil)
+
+	_ = f.PublishMessage(c, "task1")
+	_ = f.PublishMessage(c, "task2")
+
+	msg := f.FetchMessage(c)
+	if msg.Body != "task1" {
+		t.Fatalf("unexpected message: %s", msg.Body)
+	}
+	if err := msg.Nack(); err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Ack(); err == nil {
+		t.Error("ack after nack should fail")
+	}
+
+	if body := fetch(t, f); body != "task2" {
+		t.Errorf("unexpected message: %s", body)
+	}
+	if body := fetch(t, f); body != "task1" {
+		t.Errorf("nacked message should be redelivered, got %s", body)
+	}
+
+	if err := f.WaitIdle(c); err != nil {
+		t.Fatal(err)
+	}
+	stats := f.Stats()
+	if stats.Published != 2 || stats.Delivered != 3 || stats.Acked != 2 || stats.Nacked != 1 || stats.Redelivered != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestVisibilityTimeout(t *testing.T) {
+	c := context.Background()
+	f := newFactory(t, nil)
+	f.VisibilityTimeout = 20 * time.Millisecond
+
+	_ = f.PublishMessage(c, "task1")
+	msg := f.FetchMessage(c) // Never acked
+	if body := fetch(t, f); body != "task1" {
+		t.Errorf("unexpected message: %s", body)
+	}
+	if err := msg.Ack(); err == nil {
+		t.Error("ack after redelivery should fail")
+	}
+}
+
+func TestDelay(t *testing.T) {
+	c := context.Background()
+	f := newFactory(t, nil)
+
+	start := time.Now()
+	_ = f.PublishDelayMessage(c, "task1", 50*time.Millisecond)
+	if _, _, delayed := f.Len(); delayed != 1 {
+		t.Errorf("expected 1 delayed message, got %d", delayed)
+	}
+	fetch(t, f)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("delivered too early: %s", elapsed)
+	}
+}
+
+func TestStop(t *testing.T) {
+	f := newFactory(t, nil)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		f.Stop()
+	}()
+	if msg := f.FetchMessage(context.Background()); msg.Body != "" {
+		t.Errorf("unexpected message: %s", msg.Body)
+	}
+	if err := f.PublishMessage(context.Background(), "task1"); err == nil {
+		t.Error("publish after stop should fail")
+	}
+}
+
+func TestInitMQOnce(t *testing.T) {
+	(&Factory{}).Stop() // Before InitMQ
+
+	c := context.Background()
+	f := newFactory(t, nil)
+	f.RecordPublished = true
+	fetched := make(chan string)
+	go func() { fetched <- f.FetchMessage(c).Body }()
+	time.Sleep(10 * time.Millisecond) // Blocked in FetchMessage
+
+	if err := f.InitMQ(util.Config{"visibilityTimeout": int64(1)}); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.PublishMessage(c, "task1")
+	select {
+	case body := <-fetched:
+		if body != "task1" {
+			t.Errorf("unexpected message: %s", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the blocked fetcher was stranded by InitMQ")
+	}
+	if f.VisibilityTimeout != 0 || len(f.Published()) != 1 {
+		t.Errorf("InitMQ should only take effect once: %s, %v", f.VisibilityTimeout, f.Published())
+	}
+}
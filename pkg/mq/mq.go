@@ -3,6 +3,8 @@ package mq
 import (
 	"context"
 	"github.com/HEUDavid/go-fsm/pkg/util"
+	"gorm.io/gorm"
+	"time"
 )
 
 type Message struct {
@@ -16,6 +18,22 @@ type IMQ interface {
 	GetMQSection() string
 	InitMQ(config util.Config) error
 	PublishMessage(c context.Context, msg string) error
+	// PublishDelayMessage Delivers msg after delay
+	PublishDelayMessage(c context.Context, msg string, delay time.Duration) error
+	// FetchMessage Blocks until a message arrives, returns an empty Message when c is done or the MQ is stopped
 	FetchMessage(c context.Context) Message
 	Start()
+	Stop()
+}
+
+// ITxMQ is implemented by queues stored in the task database,
+// messages are published within the task transaction instead of after the commit.
+type ITxMQ interface {
+	PublishMessageTx(c context.Context, tx *gorm.DB, msg string) error
+}
+
+// IPrefetch is implemented by queues which limit the unacked messages sent to a consumer,
+// the Worker sets it to its MaxGoroutines.
+type IPrefetch interface {
+	SetPrefetch(n int)
 }
@@ -0,0 +1,233 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/HEUDavid/go-fsm/pkg/mq"
+	"github.com/HEUDavid/go-fsm/pkg/util"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"log"
+	"strconv"
+	"time"
+)
+
+const deliverAtHeader = "Fsm-Deliver-At" // Unix milliseconds, the consumer naks the message until then
+
+// Factory NATS JetStream durable pull consumer. The message is redelivered by the server if it is not acked
+// within AckWait, which is extended while the message is being handled. Nack is nak with NakDelay,
+// at most MaxDeliver deliveries are made, after that the message is left in the stream.
+// A delayed message is naked until it is due, which uses up a delivery, so on its last allowed delivery it is
+// published again instead, and the delays never make the server give up a message before the RetryPolicy does.
+// Config: url, stream, subject (default the stream name), durable, maxDeliver (default unlimited, at least 2),
+// ackWait (seconds, default 30), nakDelay (seconds, default 0), batchSize (default 10)
+type Factory struct {
+	Section    string
+	buffer     chan *mq.Message
+	conn       *nats.Conn
+	js         jetstream.JetStream
+	consumer   jetstream.Consumer
+	stream     string
+	subject    string
+	durable    string
+	maxDeliver int
+	ackWait    time.Duration
+	nakDelay   time.Duration
+	batchSize  int
+	ctx        context.Context // Done when stopped
+	stop       context.CancelFunc
+}
+
+func (f *Factory) GetMQSection() string {
+	return f.Section
+}
+
+func (f *Factory) InitMQ(config util.Config) error {
+	var ok bool
+	if f.stream, ok = config["stream"].(string); !ok {
+		return fmt.Errorf("nats stream not configured")
+	}
+	if f.durable, ok = config["durable"].(string); !ok {
+		return fmt.Errorf("nats durable not configured")
+	}
+	if f.subject, ok = config["subject"].(string); !ok {
+		f.subject = f.stream
+	}
+	f.maxDeliver = -1
+	if maxDeliver, ok := config["maxDeliver"].(int64); ok {
+		f.maxDeliver = int(maxDeliver)
+	}
+	if f.maxDeliver == 1 {
+		return fmt.Errorf("nats maxDeliver should be at least 2, a delayed message is delivered before it is due")
+	}
+	f.ackWait = 30 * time.Second
+	if ackWait, ok := config["ackWait"].(int64); ok {
+		if ackWait < 2 {
+			return fmt.Errorf("nats ackWait should be at least 2 seconds")
+		}
+		f.ackWait = time.Duration(ackWait) * time.Second
+	}
+	if nakDelay, ok := config["nakDelay"].(int64); ok {
+		f.nakDelay = time.Duration(nakDelay) * time.Second
+	}
+	f.batchSize = 10
+	if batchSize, ok := config["batchSize"].(int64); ok {
+		f.batchSize = int(batchSize)
+	}
+
+	url, _ := config["url"].(string)
+	conn, err := nats.Connect(url, nats.MaxReconnects(-1))
+	if err != nil {
+		return fmt.Errorf("error connecting nats: %w", err)
+	}
+	f.conn = conn
+	if f.js, err = jetstream.New(conn); err != nil {
+		return err
+	}
+
+	f.buffer = make(chan *mq.Message)
+	f.ctx, f.stop = context.WithCancel(context.Background())
+
+	if _, err = f.js.CreateOrUpdateStream(f.ctx, jetstream.StreamConfig{
+		Name:     f.stream,
+		Subjects: []string{f.subject},
+	}); err != nil {
+		return fmt.Errorf("error creating stream: %w", err)
+	}
+	f.consumer, err = f.js.CreateOrUpdateConsumer(f.ctx, f.stream, jetstream.ConsumerConfig{
+		Durable:       f.durable,
+		FilterSubject: f.subject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       f.ackWait,
+		MaxDeliver:    f.maxDeliver,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating consumer: %w", err)
+	}
+
+	return nil
+}
+
+func (f *Factory) PublishMessage(c context.Context, msg string) error {
+	_, err := f.js.Publish(c, f.subject, []byte(msg))
+	return err
+}
+
+// PublishDelayMessage The message is published at once, the consumer naks it with the remaining delay
+func (f *Factory) PublishDelayMessage(c context.Context, msg string, delay time.Duration) error {
+	message := nats.NewMsg(f.subject)
+	message.Data = []byte(msg)
+	message.Header.Set(deliverAtHeader, strconv.FormatInt(time.Now().Add(delay).UnixMilli(), 10))
+	_, err := f.js.PublishMsg(c, message)
+	return err
+}
+
+func (f *Factory) FetchMessage(c context.Context) mq.Message {
+	select {
+	case msg := <-f.buffer:
+		return *msg
+	case <-c.Done():
+	case <-f.ctx.Done():
+	}
+	return mq.Message{C: c}
+}
+
+func (f *Factory) Start() {
+	go func() {
+		for f.ctx.Err() == nil {
+			batch, err := f.consumer.Fetch(f.batchSize, jetstream.FetchMaxWait(time.Second))
+			if err != nil {
+				log.Printf("[FSM] nats fetching message Err: %v", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			// Every message is renewed as soon as it arrives, the rest of the batch waits for the buffer
+			arrived := make(chan leased, f.batchSize)
+			go func() {
+				defer close(arrived)
+				for message := range batch.Messages() {
+					if delay := time.Until(deliverAt(message)); delay > 0 {
+						if e := f.delay(message, delay); e != nil {
+							log.Printf("[FSM] nats delaying message Err: %v", e)
+						}
+						continue
+					}
+					arrived <- leased{message: message, lease: f.lease(message)}
+				}
+			}()
+			for l := range arrived {
+				f.deliver(l.message, l.lease)
+			}
+			if err = batch.Error(); err != nil && !errors.Is(err, nats.ErrTimeout) && f.ctx.Err() == nil {
+				log.Printf("[FSM] nats fetching message Err: %v", err)
+			}
+		}
+	}()
+}
+
+func (f *Factory) Stop() {
+	f.stop()
+	_ = f.conn.Drain()
+}
+
+// delay Naks the message until it is due, or publishes it again if this is its last allowed delivery
+func (f *Factory) delay(message jetstream.Msg, delay time.Duration) error {
+	meta, err := message.Metadata()
+	if err != nil {
+		return err
+	}
+	if f.maxDeliver <= 0 || meta.NumDelivered < uint64(f.maxDeliver) {
+		return message.NakWithDelay(delay)
+	}
+
+	again := nats.NewMsg(f.subject)
+	again.Data = message.Data()
+	again.Header.Set(deliverAtHeader, message.Headers().Get(deliverAtHeader))
+	if _, err = f.js.PublishMsg(f.ctx, again); err != nil {
+		return err
+	}
+	return message.Ack()
+}
+
+// leased is a fetched message whose AckWait is being extended
+type leased struct {
+	message jetstream.Msg
+	lease   *mq.Lease
+}
+
+// lease Extends AckWait of the message until it is acked or nacked
+func (f *Factory) lease(message jetstream.Msg) *mq.Lease {
+	return mq.NewLease(f.ctx, f.ackWait/2, func() bool {
+		if err := message.InProgress(); err != nil {
+			log.Printf("[FSM] nats extending ack wait Err: %v", err)
+		}
+		return true
+	})
+}
+
+// deliver Hands the message to FetchMessage
+func (f *Factory) deliver(message jetstream.Msg, lease *mq.Lease) {
+	lease.Deliver(f.ctx, f.buffer, &mq.Message{ // Redelivered after AckWait if stopped
+		C:    context.Background(),
+		Body: string(message.Data()),
+		Ack: func() error {
+			return lease.Settle(message.Ack, jetstream.ErrMsgAlreadyAckd)
+		},
+		Nack: func() error {
+			return lease.Settle(func() error {
+				if f.nakDelay > 0 {
+					return message.NakWithDelay(f.nakDelay)
+				}
+				return message.Nak()
+			}, jetstream.ErrMsgAlreadyAckd)
+		},
+	})
+}
+
+func deliverAt(message jetstream.Msg) time.Time {
+	if ms, err := strconv.ParseInt(message.Headers().Get(deliverAtHeader), 10, 64); err == nil {
+		return time.UnixMilli(ms)
+	}
+	return time.Time{}
+}
@@ -0,0 +1,127 @@
+package nats
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/HEUDavid/go-fsm/pkg/util"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func runServer(t *testing.T) string {
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	return s.ClientURL()
+}
+
+func newFactory(t *testing.T, url string, config util.Config) *Factory {
+	config["url"], config["stream"], config["durable"] = url, "fsm", "worker"
+	f := &Factory{Section: "nats"}
+	if err := f.InitMQ(config); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(f.Stop)
+	return f
+}
+
+func fetch(t *testing.T, f *Factory, timeout time.Duration) string {
+	c, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	msg := f.FetchMessage(c)
+	if msg.Body != "" {
+		if err := msg.Ack(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return msg.Body
+}
+
+func TestAckAndNack(t *testing.T) {
+	c := context.Background()
+	f := newFactory(t, runServer(t), util.Config{})
+	f.Start()
+
+	_ = f.PublishMessage(c, "task1")
+	msg := f.FetchMessage(c)
+	if msg.Body != "task1" {
+		t.Fatalf("unexpected message: %s", msg.Body)
+	}
+	if err := msg.Nack(); err != nil {
+		t.Fatal(err)
+	}
+	if body := fetch(t, f, 2*time.Second); body != "task1" {
+		t.Errorf("nacked message should be redelivered, got %q", body)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	c := context.Background()
+	f := newFactory(t, runServer(t), util.Config{})
+	f.Start()
+
+	start := time.Now()
+	_ = f.PublishDelayMessage(c, "task1", 300*time.Millisecond)
+	if body := fetch(t, f, 2*time.Second); body != "task1" || time.Since(start) < 290*time.Millisecond {
+		t.Errorf("unexpected message %q after %s", body, time.Since(start))
+	}
+}
+
+// TestDelayLastDelivery The delayed message has used up all deliveries but one, its nak would make the server give it up
+func TestDelayLastDelivery(t *testing.T) {
+	c := context.Background()
+	f := newFactory(t, runServer(t), util.Config{"maxDeliver": int64(2)})
+
+	_ = f.PublishDelayMessage(c, "task1", 500*time.Millisecond)
+	batch, err := f.consumer.Fetch(1, jetstream.FetchMaxWait(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for message := range batch.Messages() {
+		_ = message.Nak() // First delivery, e.g. of a crashed consumer
+	}
+
+	f.Start()
+	if body := fetch(t, f, 3*time.Second); body != "task1" {
+		t.Errorf("delayed message should be delivered when due, got %q", body)
+	}
+}
+
+func TestRenewWholeBatch(t *testing.T) {
+	c := context.Background()
+	f := newFactory(t, runServer(t), util.Config{"ackWait": int64(2)})
+	_ = f.PublishMessage(c, "task1")
+	_ = f.PublishMessage(c, "task2")
+	f.Start()
+	time.Sleep(3 * time.Second) // Nothing fetched, both messages wait locally past AckWait
+
+	batch, err := f.consumer.Fetch(1, jetstream.FetchMaxWait(300*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for message := range batch.Messages() {
+		t.Errorf("message %s should be renewed, not redelivered", message.Data())
+	}
+}
+
+func TestMaxDeliver(t *testing.T) {
+	f := &Factory{}
+	if err := f.InitMQ(util.Config{"stream": "fsm", "durable": "worker", "maxDeliver": int64(1)}); err == nil {
+		t.Error("maxDeliver 1 should be rejected")
+	}
+}
+
+func TestAckWait(t *testing.T) {
+	f := &Factory{}
+	if err := f.InitMQ(util.Config{"stream": "fsm", "durable": "worker", "ackWait": int64(1)}); err == nil {
+		t.Error("ackWait 1 should be rejected")
+	}
+}
@@ -0,0 +1,279 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/HEUDavid/go-fsm/pkg/mq"
+	"github.com/HEUDavid/go-fsm/pkg/util"
+	"github.com/redis/go-redis/v9"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const bodyField = "body"
+
+// owned Guards the scripts below, the entry must be still pending on this consumer,
+// otherwise it has been reclaimed by another consumer after this one was considered dead.
+const owned = `
+local pending = redis.call('XPENDING', KEYS[1], ARGV[1], ARGV[3], ARGV[3], 1, ARGV[2])
+if #pending == 0 then
+	return 0
+end
+`
+
+// KEYS: stream; ARGV: group, consumer, id
+var ackScript = redis.NewScript(owned + `
+redis.call('XACK', KEYS[1], ARGV[1], ARGV[3])
+redis.call('XDEL', KEYS[1], ARGV[3])
+return 1
+`)
+
+// KEYS: stream; ARGV: group, consumer, id, body
+var nackScript = redis.NewScript(owned + `
+redis.call('XADD', KEYS[1], '*', 'body', ARGV[4])
+redis.call('XACK', KEYS[1], ARGV[1], ARGV[3])
+redis.call('XDEL', KEYS[1], ARGV[3])
+return 1
+`)
+
+// KEYS: stream; ARGV: group, consumer, id
+var renewScript = redis.NewScript(owned + `
+redis.call('XCLAIM', KEYS[1], ARGV[1], ARGV[2], 0, ARGV[3], 'JUSTID')
+return 1
+`)
+
+// KEYS: delay set, stream; ARGV: now in milliseconds, count
+var moveScript = redis.NewScript(`
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, member in ipairs(members) do
+	redis.call('XADD', KEYS[2], '*', 'body', string.sub(member, 33))
+	redis.call('ZREM', KEYS[1], member)
+end
+return #members
+`)
+
+// Factory Redis Streams consumer group. An entry stays in the pending list of its consumer until acked,
+// entries idle longer than ClaimIdle (the consumer died) are reclaimed by XAUTOCLAIM,
+// the entries being handled are claimed again periodically so they are not taken away.
+// Nack adds the message to the stream again. Delayed messages wait in the sorted set `<stream>:delay`.
+// Config: addr, password, db, stream, group, consumer (default hostname plus a random suffix),
+// claimIdle (seconds, default 30), block (milliseconds, default 1000), batchSize (default 10)
+type Factory struct {
+	Section   string
+	client    *redis.Client
+	stream    string
+	delaySet  string
+	group     string
+	consumer  string
+	claimIdle time.Duration
+	block     time.Duration
+	batchSize int64
+	cursor    string // Of XAUTOCLAIM over the pending entries, only used by the receiving goroutine
+	buffer    chan *mq.Message
+	ctx       context.Context // Done when stopped
+	stop      context.CancelFunc
+}
+
+func (f *Factory) GetMQSection() string {
+	return f.Section
+}
+
+func (f *Factory) InitMQ(config util.Config) error {
+	options := &redis.Options{}
+	options.Addr, _ = config["addr"].(string)
+	options.Password, _ = config["password"].(string)
+	if db, ok := config["db"].(int64); ok {
+		options.DB = int(db)
+	}
+	f.client = redis.NewClient(options)
+
+	var ok bool
+	if f.stream, ok = config["stream"].(string); !ok {
+		return fmt.Errorf("redis stream not configured")
+	}
+	if f.group, ok = config["group"].(string); !ok {
+		return fmt.Errorf("redis group not configured")
+	}
+	f.delaySet = f.stream + ":delay"
+	if f.consumer, ok = config["consumer"].(string); !ok {
+		hostname, _ := os.Hostname()
+		f.consumer = hostname + "-" + util.UniqueID()[:8]
+	}
+	f.claimIdle = 30 * time.Second
+	if idle, ok := config["claimIdle"].(int64); ok {
+		if idle < 2 {
+			return fmt.Errorf("redis claimIdle should be at least 2 seconds")
+		}
+		f.claimIdle = time.Duration(idle) * time.Second
+	}
+	f.block = time.Second
+	if block, ok := config["block"].(int64); ok {
+		f.block = time.Duration(block) * time.Millisecond
+	}
+	f.batchSize = 10
+	if batchSize, ok := config["batchSize"].(int64); ok {
+		f.batchSize = batchSize
+	}
+
+	f.buffer = make(chan *mq.Message)
+	f.ctx, f.stop = context.WithCancel(context.Background())
+
+	return f.client.Ping(f.ctx).Err()
+}
+
+func (f *Factory) PublishMessage(c context.Context, msg string) error {
+	return f.client.XAdd(c, &redis.XAddArgs{Stream: f.stream, Values: []interface{}{bodyField, msg}}).Err()
+}
+
+// PublishDelayMessage The message is moved to the stream when due, the member is prefixed by a unique ID
+// so the same message can be delayed more than once.
+func (f *Factory) PublishDelayMessage(c context.Context, msg string, delay time.Duration) error {
+	return f.client.ZAdd(c, f.delaySet, redis.Z{
+		Score:  float64(time.Now().Add(delay).UnixMilli()),
+		Member: util.UniqueID() + msg,
+	}).Err()
+}
+
+func (f *Factory) FetchMessage(c context.Context) mq.Message {
+	select {
+	case msg := <-f.buffer:
+		return *msg
+	case <-c.Done():
+	case <-f.ctx.Done():
+	}
+	return mq.Message{C: c}
+}
+
+func (f *Factory) Start() {
+	err := f.client.XGroupCreateMkStream(f.ctx, f.stream, f.group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		log.Printf("[FSM] redis creating group Err: %v", err)
+	}
+
+	go f.moveDelayed()
+	go func() {
+		for f.ctx.Err() == nil {
+			messages, err := f.receive()
+			if err != nil && f.ctx.Err() == nil {
+				log.Printf("[FSM] redis receiving message Err: %v", err)
+				time.Sleep(time.Second)
+			}
+			leases := make([]*mq.Lease, len(messages))
+			for i, message := range messages { // Renewed at once, the rest of the batch waits for the buffer
+				leases[i] = mq.NewLease(f.ctx, f.claimIdle/2, func() bool { return f.renew(message.ID) })
+			}
+			for i, message := range messages {
+				f.deliver(message, leases[i])
+			}
+		}
+	}()
+}
+
+func (f *Factory) Stop() {
+	f.stop()
+	_ = f.client.Close()
+}
+
+// receive Reclaims the entries of dead consumers first, then reads new ones.
+// Each call scans the next page of the pending entries, the scan restarts once the cursor is back to "0-0".
+func (f *Factory) receive() ([]redis.XMessage, error) {
+	if f.cursor == "" {
+		f.cursor = "0"
+	}
+	claimed, cursor, err := f.client.XAutoClaim(f.ctx, &redis.XAutoClaimArgs{
+		Stream:   f.stream,
+		Group:    f.group,
+		Consumer: f.consumer,
+		MinIdle:  f.claimIdle,
+		Start:    f.cursor,
+		Count:    f.batchSize,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	f.cursor = cursor
+	if cursor == "0-0" {
+		f.cursor = "0"
+	}
+	if len(claimed) > 0 {
+		return claimed, nil
+	}
+
+	streams, err := f.client.XReadGroup(f.ctx, &redis.XReadGroupArgs{
+		Group:    f.group,
+		Consumer: f.consumer,
+		Streams:  []string{f.stream, ">"},
+		Count:    f.batchSize,
+		Block:    f.block,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var messages []redis.XMessage
+	for _, stream := range streams {
+		messages = append(messages, stream.Messages...)
+	}
+	return messages, nil
+}
+
+func (f *Factory) moveDelayed() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-f.ctx.Done():
+			return
+		}
+		err := moveScript.Run(f.ctx, f.client, []string{f.delaySet, f.stream}, time.Now().UnixMilli(), f.batchSize).Err()
+		if err != nil && f.ctx.Err() == nil {
+			log.Printf("[FSM] redis moving delayed message Err: %v", err)
+		}
+	}
+}
+
+// deliver Hands the entry to FetchMessage, it is claimed again periodically by its lease until acked or nacked
+func (f *Factory) deliver(message redis.XMessage, lease *mq.Lease) {
+	body, _ := message.Values[bodyField].(string)
+	settle := func(script *redis.Script, args ...interface{}) error {
+		return lease.Settle(func() error {
+			n, err := script.Run(context.Background(), f.client, []string{f.stream},
+				append([]interface{}{f.group, f.consumer, message.ID}, args...)...).Int64()
+			if err == nil && n == 0 {
+				err = fmt.Errorf("message %s reclaimed by another consumer", message.ID)
+			}
+			return err
+		}, fmt.Errorf("message %s already settled", message.ID))
+	}
+
+	lease.Deliver(f.ctx, f.buffer, &mq.Message{ // Stays pending if stopped, reclaimed after ClaimIdle
+		C:    context.Background(),
+		Body: body,
+		Ack: func() error {
+			return settle(ackScript)
+		},
+		Nack: func() error {
+			return settle(nackScript, body)
+		},
+	})
+}
+
+// renew Claims the entry again to reset its idle time, false once another consumer has reclaimed it
+func (f *Factory) renew(id string) bool {
+	n, err := renewScript.Run(context.Background(), f.client, []string{f.stream}, f.group, f.consumer, id).Int64()
+	if err != nil {
+		log.Printf("[FSM] redis renewing message %s Err: %v", id, err)
+		return true
+	}
+	if n == 0 {
+		log.Printf("[FSM] redis message %s reclaimed by another consumer", id)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,180 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/HEUDavid/go-fsm/pkg/util"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newFactory(t *testing.T, server *miniredis.Miniredis, consumer string) *Factory {
+	f := &Factory{Section: "redis"}
+	if err := f.InitMQ(util.Config{
+		"addr":      server.Addr(),
+		"stream":    "fsm",
+		"group":     "worker",
+		"consumer":  consumer,
+		"claimIdle": int64(2),
+		"block":     int64(50),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	f.Start()
+	t.Cleanup(f.Stop)
+	return f
+}
+
+func fetch(t *testing.T, f *Factory) (string, func() error, func() error) {
+	c, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	msg := f.FetchMessage(c)
+	if msg.Body == "" {
+		t.Fatal("no message fetched")
+	}
+	return msg.Body, msg.Ack, msg.Nack
+}
+
+func TestAckAndNack(t *testing.T) {
+	c := context.Background()
+	server := miniredis.RunT(t)
+	f := newFactory(t, server, "c1")
+
+	_ = f.PublishMessage(c, "task1")
+	_ = f.PublishMessage(c, "task2")
+
+	body, ack, nack := fetch(t, f)
+	if body != "task1" {
+		t.Fatalf("unexpected message: %s", body)
+	}
+	if err := nack(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ack(); err == nil {
+		t.Error("ack after nack should fail")
+	}
+
+	for _, want := range []string{"task2", "task1"} {
+		body, ack, _ = fetch(t, f)
+		if body != want {
+			t.Errorf("unexpected message: %s, want %s", body, want)
+		}
+		if err := ack(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := f.client.XLen(c, f.stream).Val(); n != 0 {
+		t.Errorf("acked messages should be deleted, %d left", n)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	c := context.Background()
+	server := miniredis.RunT(t)
+	f := newFactory(t, server, "c1")
+
+	start := time.Now()
+	_ = f.PublishDelayMessage(c, "task1", 200*time.Millisecond)
+	body, ack, _ := fetch(t, f)
+	if body != "task1" || time.Since(start) < 200*time.Millisecond {
+		t.Fatalf("unexpected delivery: %s after %s", body, time.Since(start))
+	}
+	if err := ack(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReclaim(t *testing.T) {
+	c := context.Background()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	if err := client.XGroupCreateMkStream(c, "fsm", "worker", "0").Err(); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.XAdd(c, &redis.XAddArgs{Stream: "fsm", Values: map[string]interface{}{bodyField: "task1"}}).Err()
+	// Read by a consumer dying before acking
+	if err := client.XReadGroup(c, &redis.XReadGroupArgs{Group: "worker", Consumer: "dead", Streams: []string{"fsm", ">"}}).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	server.SetTime(time.Now().Add(3 * time.Second))
+	alive := newFactory(t, server, "alive")
+	body, ack, _ := fetch(t, alive)
+	if body != "task1" {
+		t.Errorf("unexpected message: %s", body)
+	}
+	if err := ack(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReclaimCursor(t *testing.T) {
+	c := context.Background()
+	server := miniredis.RunT(t)
+	f := &Factory{Section: "redis"} // Not started, receive is called directly
+	if err := f.InitMQ(util.Config{
+		"addr": server.Addr(), "stream": "fsm", "group": "worker", "consumer": "alive",
+		"claimIdle": int64(2), "batchSize": int64(1),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+
+	if err := f.client.XGroupCreateMkStream(c, "fsm", "worker", "0").Err(); err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"task1", "task2", "task3"} {
+		_ = f.client.XAdd(c, &redis.XAddArgs{Stream: "fsm", Values: map[string]interface{}{bodyField: body}}).Err()
+	}
+	// Read by a consumer dying before acking
+	if err := f.client.XReadGroup(c, &redis.XReadGroupArgs{Group: "worker", Consumer: "dead", Streams: []string{"fsm", ">"}}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	server.SetTime(time.Now().Add(3 * time.Second))
+
+	for i, body := range []string{"task1", "task2", "task3"} {
+		messages, err := f.receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 1 || messages[0].Values[bodyField] != body {
+			t.Fatalf("unexpected messages of %s: %v", body, messages)
+		}
+		if last := i == 2; (f.cursor == "0") != last {
+			t.Errorf("unexpected cursor %s after %s", f.cursor, body)
+		}
+	}
+}
+
+func TestClaimIdle(t *testing.T) {
+	server := miniredis.RunT(t)
+	f := &Factory{}
+	if err := f.InitMQ(util.Config{"addr": server.Addr(), "stream": "fsm", "group": "worker", "claimIdle": int64(1)}); err == nil {
+		t.Error("claimIdle 1 should be rejected")
+	}
+}
+
+func TestRenewWholeBatch(t *testing.T) {
+	c := context.Background()
+	server := miniredis.RunT(t)
+	f := newFactory(t, server, "alive")
+	_ = f.PublishMessage(c, "task1")
+	_ = f.PublishMessage(c, "task2")
+	time.Sleep(1500 * time.Millisecond) // Nothing fetched, both entries wait locally
+
+	pending, err := f.client.XPendingExt(c, &redis.XPendingExtArgs{Stream: "fsm", Group: "worker", Start: "-", End: "+", Count: 10}).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 {
+		t.Fatalf("expected 2 pending entries, got %v", pending)
+	}
+	for _, p := range pending {
+		if p.Idle >= time.Second {
+			t.Errorf("entry %s should be renewed, idle for %s", p.ID, p.Idle)
+		}
+	}
+}
@@ -2,68 +2,230 @@ package rmq
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/HEUDavid/go-fsm/pkg/mq"
 	"github.com/HEUDavid/go-fsm/pkg/util"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"log"
+	"strconv"
+	"sync"
 	"time"
 )
 
+// ErrChannelClosed is returned while the client is disconnected from the broker
+var ErrChannelClosed = errors.New("rabbitmq channel closed")
+
+// State is the connection state of RabbitmqClient
+type State int32
+
+const (
+	Connecting State = iota // Not connected yet, or reconnecting
+	Connected
+	Stopped
+)
+
+func (s State) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Stopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// RabbitmqClient keeps one connection and channel to the broker, replaced by Reconnect when either is closed.
+// They are guarded by mu, the consumer is established again on every new channel.
 type RabbitmqClient struct {
+	mu        sync.RWMutex
 	conn      *amqp.Connection
 	channel   *amqp.Channel
+	ready     chan struct{} // Closed when the current channel is established, replaced on disconnection
+	state     State
+	lastErr   error // The last connection or channel error
 	buffer    chan *mq.Message
 	url       string
 	queueName string
+	Durable   bool          // Declares durable queues and publishes persistent messages, so they survive a broker restart
+	Prefetch  int           // Unacked deliveries the broker sends to the consumer at most, 0 means unlimited
+	done      chan struct{} // Closed when stopped
 }
 
 func NewRmqClient(url, queue string) *RabbitmqClient {
-	return &RabbitmqClient{url: url, queueName: queue}
+	return &RabbitmqClient{url: url, queueName: queue, ready: make(chan struct{}), done: make(chan struct{})}
 }
 
 func (r *RabbitmqClient) Connect() error {
-	var err error
-
-	if r.conn, err = amqp.Dial(r.url); err != nil {
+	conn, err := amqp.Dial(r.url)
+	if err != nil {
 		return err
 	}
 
-	if r.channel, err = r.conn.Channel(); err != nil {
+	channel, err := r.setup(conn)
+	if err != nil {
+		_ = conn.Close()
 		return err
 	}
 
-	if _, err = r.channel.QueueDeclare(
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state == Stopped {
+		_ = conn.Close()
+		return ErrChannelClosed
+	}
+	r.conn, r.channel, r.state, r.lastErr = conn, channel, Connected, nil
+	close(r.ready)
+
+	log.Printf("[FSM] rabbitmq(%p) connected successfully", r)
+	return nil
+}
+
+func (r *RabbitmqClient) setup(conn *amqp.Connection) (*amqp.Channel, error) {
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	// Publishing waits for the broker to confirm each message
+	if err = channel.Confirm(false); err != nil {
+		return nil, err
+	}
+
+	if r.Prefetch > 0 {
+		if err = channel.Qos(r.Prefetch, 0, false); err != nil {
+			return nil, err
+		}
+	}
+
+	// Redeclaring an existing queue with another durability fails, delete the queue first when changing it
+	if _, err = channel.QueueDeclare(
 		r.queueName,
-		false,
+		r.Durable,
 		false,
 		false,
 		false,
 		nil,
 	); err != nil {
-		return err
+		return nil, err
 	}
 
-	log.Printf("[FSM] rabbitmq(%p) connected successfully", r)
-	return nil
+	// Delayed messages wait in the delay queue of their bucket until the TTL of the queue, then are dead-lettered
+	// to the queue. All messages of a bucket share the TTL, so a short delay never waits behind a longer one.
+	for _, bucket := range DelayBuckets {
+		if _, err = channel.QueueDeclare(
+			r.delayQueueName(bucket),
+			r.Durable,
+			false,
+			false,
+			false,
+			amqp.Table{
+				"x-message-ttl":             bucket.Milliseconds(),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": r.queueName,
+			},
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	return channel, nil
 }
 
 func (r *RabbitmqClient) Reconnect() {
-	for {
+	for !r.stopped() {
 		if err := r.Connect(); err != nil {
+			r.disconnected(err)
 			log.Printf("[FSM] rabbitmq(%p) connect Err: %v", r, err)
-			time.Sleep(time.Second * 3)
+			select {
+			case <-time.After(time.Second * 3):
+			case <-r.done:
+			}
 			continue
 		}
 
-		// 阻塞监听通道关闭事件
-		connClose := make(chan *amqp.Error)
-		r.conn.NotifyClose(connClose)
+		// 阻塞监听连接或通道关闭事件, 通道单独关闭(例如声明冲突)时也重建连接
+		r.mu.RLock()
+		conn, channel := r.conn, r.channel
+		r.mu.RUnlock()
+		connClose := conn.NotifyClose(make(chan *amqp.Error, 1))
+		channelClose := channel.NotifyClose(make(chan *amqp.Error, 1))
 
+		var err *amqp.Error
 		select {
-		case <-connClose:
-			log.Printf("[FSM] rabbitmq(%p) closed, reconnect...", r)
+		case err = <-connClose:
+		case err = <-channelClose:
+		case <-r.done:
+			return
+		}
+		log.Printf("[FSM] rabbitmq(%p) closed: %v, reconnect...", r, err)
+		if err != nil {
+			r.disconnected(err)
+		} else {
+			r.disconnected(ErrChannelClosed)
 		}
+		_ = conn.Close()
+	}
+}
+
+// disconnected Marks the client as reconnecting, waiters of ready block until the next channel
+func (r *RabbitmqClient) disconnected(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastErr = err
+	if r.state != Connected {
+		return
+	}
+	r.state = Connecting
+	r.ready = make(chan struct{})
+}
+
+// State Returns the connection state and the last connection error
+func (r *RabbitmqClient) State() (State, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.state, r.lastErr
+}
+
+// Healthy Whether the client is connected to the broker
+func (r *RabbitmqClient) Healthy() bool {
+	state, _ := r.State()
+	return state == Connected
+}
+
+// WaitReady Blocks until the client is connected, c is done or the client is stopped
+func (r *RabbitmqClient) WaitReady(c context.Context) error {
+	r.mu.RLock()
+	ready := r.ready
+	r.mu.RUnlock()
+	select {
+	case <-ready:
+		return nil
+	case <-c.Done():
+		return c.Err()
+	case <-r.done:
+		return ErrChannelClosed
+	}
+}
+
+// getChannel Returns the current channel, ErrChannelClosed if disconnected
+func (r *RabbitmqClient) getChannel() (*amqp.Channel, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.state != Connected || r.channel.IsClosed() {
+		return nil, ErrChannelClosed
+	}
+	return r.channel, nil
+}
+
+func (r *RabbitmqClient) stopped() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -72,6 +234,13 @@ func (r *RabbitmqClient) Start() {
 }
 
 func (r *RabbitmqClient) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state == Stopped {
+		return
+	}
+	r.state = Stopped
+	close(r.done)
 	if r.channel != nil {
 		_ = r.channel.Close()
 	}
@@ -80,15 +249,20 @@ func (r *RabbitmqClient) Stop() {
 	}
 }
 
+// Consume Consumes on every new channel until stopped, the deliveries channel is closed when the channel is
 func (r *RabbitmqClient) Consume() error {
 	for {
-		if r.channel == nil || r.channel.IsClosed() {
-			time.Sleep(time.Second)
+		if err := r.WaitReady(context.Background()); err != nil {
+			return nil // Stopped
+		}
+		channel, err := r.getChannel()
+		if err != nil { // Closed, Reconnect is notified
+			r.disconnected(err)
 			continue
 		}
 
 		log.Printf("[FSM] rabbitmq(%p) start consuming...", r)
-		deliveries, err := r.channel.Consume(
+		deliveries, err := channel.Consume(
 			r.queueName,
 			"",
 			false,
@@ -99,40 +273,111 @@ func (r *RabbitmqClient) Consume() error {
 		)
 		if err != nil {
 			log.Printf("[FSM] rabbitmq(%p) consume Err: %v", r, err)
+			_ = channel.Close() // Reconnect establishes a new one
+			r.disconnected(err)
 			continue
 		}
 
 		for delivery := range deliveries {
-			r.buffer <- &mq.Message{
+			msg := &mq.Message{
 				C:    context.Background(),
 				Body: string(delivery.Body),
-				Ack:  func() error { return delivery.Ack(false) },
-				Nack: func() error { return delivery.Nack(false, true) },
+				Ack:  func() error { return settleErr(delivery.Ack(false)) },
+				Nack: func() error { return settleErr(delivery.Nack(false, true)) },
+			}
+			select {
+			case r.buffer <- msg:
+			case <-r.done: // Requeued by the broker when the channel is closed
+				return nil
 			}
 		}
+		log.Printf("[FSM] rabbitmq(%p) deliveries closed, waiting for reconnection...", r)
 	}
 }
 
-func (r *RabbitmqClient) Publish(body string) error {
-	if r.channel == nil || r.channel.IsClosed() {
-		return fmt.Errorf("bad rabbitmq channel")
+// settleErr The delivery can not be settled once its channel is closed, the broker redelivers it
+func settleErr(err error) error {
+	if errors.Is(err, amqp.ErrClosed) {
+		return fmt.Errorf("%w: %v", ErrChannelClosed, err)
 	}
+	return err
+}
 
-	return r.channel.Publish(
-		"",
-		r.queueName,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        []byte(body),
-		},
-	)
+func (r *RabbitmqClient) Publish(c context.Context, body string) error {
+	return r.publish(c, r.queueName, amqp.Publishing{
+		ContentType: "text/plain",
+		Body:        []byte(body),
+	})
+}
+
+// PublishDelay Publishes to the delay queue of the smallest bucket not shorter than delay,
+// delays beyond the largest bucket are capped to it.
+func (r *RabbitmqClient) PublishDelay(c context.Context, body string, delay time.Duration) error {
+	return r.publish(c, r.delayQueueName(delayBucket(delay)), amqp.Publishing{
+		ContentType: "text/plain",
+		Body:        []byte(body),
+	})
 }
 
+// publish Returns after the broker confirms the message, an error if the broker nacks it
+func (r *RabbitmqClient) publish(c context.Context, queue string, msg amqp.Publishing) error {
+	channel, err := r.getChannel()
+	if err != nil {
+		return err
+	}
+
+	if r.Durable {
+		msg.DeliveryMode = amqp.Persistent
+	}
+	confirmation, err := channel.PublishWithDeferredConfirmWithContext(c, "", queue, false, false, msg)
+	if err != nil {
+		return settleErr(err)
+	}
+	acked, err := confirmation.WaitContext(c)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		if channel.IsClosed() { // Pending confirmations are nacked when the channel is closed
+			return ErrChannelClosed
+		}
+		return fmt.Errorf("rabbitmq nacked the message")
+	}
+	return nil
+}
+
+func (r *RabbitmqClient) delayQueueName(bucket time.Duration) string {
+	return r.queueName + ".delay." + strconv.FormatInt(bucket.Milliseconds(), 10)
+}
+
+// DelayBuckets The delays of the delay queues in ascending order, set before InitMQ to change them
+var DelayBuckets = []time.Duration{
+	100 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second,
+	time.Minute, 2 * time.Minute, 5 * time.Minute, 10 * time.Minute, 30 * time.Minute,
+	time.Hour, 2 * time.Hour, 6 * time.Hour, 12 * time.Hour, 24 * time.Hour,
+}
+
+func delayBucket(delay time.Duration) time.Duration {
+	for _, bucket := range DelayBuckets {
+		if bucket >= delay {
+			return bucket
+		}
+	}
+	return DelayBuckets[len(DelayBuckets)-1]
+}
+
+// Factory RabbitMQ, config: user, password, host, port, vhost, queue,
+// durable (default false), prefetch (default the MaxGoroutines of the Worker, unlimited if neither is set)
 type Factory struct {
-	Section string
-	MQ      *RabbitmqClient
+	Section  string
+	MQ       *RabbitmqClient
+	prefetch int
+}
+
+// SetPrefetch Called by the Worker with its MaxGoroutines before InitMQ
+func (f *Factory) SetPrefetch(n int) {
+	f.prefetch = n
 }
 
 func (f *Factory) GetMQSection() string {
@@ -146,9 +391,19 @@ func (f *Factory) InitMQ(config util.Config) error {
 		),
 		config["queue"].(string),
 	)
+	f.MQ.Durable, _ = config["durable"].(bool)
+	f.MQ.Prefetch = f.prefetch
+	if prefetch, ok := config["prefetch"].(int64); ok {
+		f.MQ.Prefetch = int(prefetch)
+	}
 
 	f.MQ.Start()
-	time.Sleep(time.Second) // time for establish connection
+	c, cancel := context.WithTimeout(context.Background(), 3*time.Second) // time for establish connection
+	defer cancel()
+	if err := f.MQ.WaitReady(c); err != nil {
+		_, lastErr := f.MQ.State()
+		log.Printf("[FSM] rabbitmq(%p) not connected yet: %v", f.MQ, lastErr) // Keeps reconnecting in the background
+	}
 
 	return nil
 }
@@ -159,17 +414,31 @@ func (f *Factory) Start() {
 }
 
 func (f *Factory) Stop() {
+	if f.MQ == nil { // Not initialized
+		return
+	}
 	f.MQ.Stop()
 }
 
+// Healthy Whether the client is connected to the broker
+func (f *Factory) Healthy() bool {
+	return f.MQ != nil && f.MQ.Healthy()
+}
+
 func (f *Factory) FetchMessage(c context.Context) mq.Message {
-	msg, ok := <-f.MQ.buffer
-	if !ok {
-		return mq.Message{C: c}
+	select {
+	case msg := <-f.MQ.buffer:
+		return *msg
+	case <-c.Done():
+	case <-f.MQ.done:
 	}
-	return *msg
+	return mq.Message{C: c}
 }
 
 func (f *Factory) PublishMessage(c context.Context, msg string) error {
-	return f.MQ.Publish(msg)
+	return f.MQ.Publish(c, msg)
+}
+
+func (f *Factory) PublishDelayMessage(c context.Context, msg string, delay time.Duration) error {
+	return f.MQ.PublishDelay(c, msg, delay)
 }
@@ -0,0 +1,28 @@
+package rmq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDelayBucket(t *testing.T) {
+	for delay, expected := range map[time.Duration]time.Duration{
+		10 * time.Millisecond: 100 * time.Millisecond,
+		time.Second:           time.Second,
+		3 * time.Second:       5 * time.Second,
+		90 * time.Second:      2 * time.Minute,
+		48 * time.Hour:        24 * time.Hour,
+	} {
+		if bucket := delayBucket(delay); bucket != expected {
+			t.Errorf("%s: %s, expected %s", delay, bucket, expected)
+		}
+	}
+}
+
+func TestStopBeforeInit(t *testing.T) {
+	f := &Factory{}
+	f.Stop()
+	if f.Healthy() {
+		t.Error("uninitialized factory should not be healthy")
+	}
+}
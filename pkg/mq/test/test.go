@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"github.com/HEUDavid/go-fsm/pkg/mq"
 	"github.com/HEUDavid/go-fsm/pkg/mq/aws"
+	"github.com/HEUDavid/go-fsm/pkg/mq/kafka"
+	"github.com/HEUDavid/go-fsm/pkg/mq/nats"
+	"github.com/HEUDavid/go-fsm/pkg/mq/redis"
 	"github.com/HEUDavid/go-fsm/pkg/mq/rmq"
 	"github.com/HEUDavid/go-fsm/pkg/util"
 	"log"
@@ -17,6 +20,12 @@ func genMQ(t string) mq.IMQ {
 		return &aws.Factory{Section: "sqs_aws"}
 	case "rmq":
 		return &rmq.Factory{Section: "rmq_cloud"}
+	case "kafka":
+		return &kafka.Factory{Section: "kafka"}
+	case "nats":
+		return &nats.Factory{Section: "nats_jetstream"}
+	case "redis":
+		return &redis.Factory{Section: "redis_stream"}
 	}
 	return nil
 }
@@ -0,0 +1,99 @@
+package pkg
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/HEUDavid/go-fsm/internal"
+	. "github.com/HEUDavid/go-fsm/pkg/metadata"
+	"github.com/HEUDavid/go-fsm/pkg/util"
+)
+
+type IRelay[Data DataEntity] interface {
+	Init()
+	Run(c context.Context)
+	Relay(c context.Context) (int, error)
+}
+
+// Relay drains the outbox registered by RegisterOutboxModel to the MQ,
+// a crash between the task commit and the publishing no longer loses the message.
+// A batch is published while its rows are locked in a transaction, BatchSize bounds how long it stays open.
+type Relay[Data DataEntity] struct {
+	internal.Base[Data]
+	ReInit    func()
+	ReRun     func(c context.Context)
+	ReRelay   func(c context.Context) (int, error)
+	Interval  time.Duration // Poll interval when the outbox is drained, default 200 milliseconds
+	BatchSize int           // Max messages per poll, default 100
+}
+
+func (r *Relay[Data]) Init() {
+	if r.ReInit != nil {
+		r.ReInit()
+		return
+	}
+
+	if r.OutboxModel == nil {
+		panic("[FSM] Model outbox not registered")
+	}
+
+	if err := r.InitDB((*r.Config)[r.GetDBSection()].(util.Config)); err != nil {
+		panic(err)
+	}
+
+	if err := r.InitMQ((*r.Config)[r.GetMQSection()].(util.Config)); err != nil {
+		panic(err)
+	}
+}
+
+// Run Relays in the background until c is done
+func (r *Relay[Data]) Run(c context.Context) {
+	if r.ReRun != nil {
+		r.ReRun(c)
+		return
+	}
+
+	interval := r.Interval
+	if interval <= 0 {
+		interval = 200 * time.Millisecond
+	}
+
+	go func() {
+		for c.Err() == nil {
+			n, err := r.Relay(c)
+			if err != nil {
+				log.Printf("[FSM] relay outbox Err: %v", err)
+			}
+			if err == nil && n >= r.batchSize() { // Not drained, go on at once
+				continue
+			}
+			select {
+			case <-time.After(interval):
+			case <-c.Done():
+			}
+		}
+	}()
+}
+
+// Relay Publishes a batch of unsent outbox messages, returns the number of messages sent
+func (r *Relay[Data]) Relay(c context.Context) (int, error) {
+	if r.ReRelay != nil {
+		return r.ReRelay(c)
+	}
+
+	n, err := internal.RelayOutbox(c, r.GetDB(), r.Models, r.batchSize(), func(body string) error {
+		return r.PublishMessage(c, body)
+	})
+	if r.DEBUG && n > 0 {
+		log.Printf("[FSM] relay %d messages", n)
+	}
+	return n, err
+}
+
+func (r *Relay[Data]) batchSize() int {
+	if r.BatchSize <= 0 {
+		return 100
+	}
+	return r.BatchSize
+}
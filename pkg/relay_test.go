@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/HEUDavid/go-fsm/pkg/db/sqlite"
+	. "github.com/HEUDavid/go-fsm/pkg/metadata"
+	"github.com/HEUDavid/go-fsm/pkg/mq"
+	"github.com/HEUDavid/go-fsm/pkg/util"
+)
+
+type testOutbox struct{ Outbox }
+
+func (o *testOutbox) TableName() string { return "outbox" }
+
+func TestRelay(t *testing.T) {
+	c := context.Background()
+	adapter, _, queue := setup(t)
+	queue.RecordPublished = true
+	adapter.RegisterOutboxModel(&testOutbox{})
+	if err := adapter.GetDB().AutoMigrate(&testOutbox{}); err != nil {
+		t.Fatal(err)
+	}
+
+	relay := &Relay[*testData]{Interval: 10 * time.Millisecond, BatchSize: 2}
+	relay.Config = adapter.Config
+	relay.RegisterModel(&testData{}, &testTask{}, &testUniqueRequest{})
+	relay.RegisterOutboxModel(&testOutbox{})
+	relay.RegisterDB(&sqlite.Factory{Section: "sqlite"})
+	relay.RegisterMQ(queue)
+	relay.RegisterFSM(testFSM())
+	relay.Init()
+
+	var taskIDs []string
+	for i := 0; i < 3; i++ { // More than a batch
+		task := GenTaskInstance(util.UniqueID(), "", &testData{Amount: 100})
+		task.Type = "test"
+		task.State = testNew.GetName()
+		if err := adapter.Create(c, task); err != nil {
+			t.Fatal(err)
+		}
+		taskIDs = append(taskIDs, task.ID)
+	}
+	if published := queue.Published(); len(published) != 0 {
+		t.Fatalf("messages should wait in the outbox, published %v", published)
+	}
+
+	runCtx, stop := context.WithCancel(c)
+	relay.Run(runCtx)
+	relayed := func() (ids []string) {
+		for _, msg := range queue.Published() {
+			envelope, _ := mq.DecodeEnvelope(msg)
+			ids = append(ids, envelope.TaskID)
+		}
+		return ids
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(relayed()) < len(taskIDs); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("outbox not relayed, published %v", relayed())
+		}
+	}
+	if ids := relayed(); !slices.Equal(ids, taskIDs) {
+		t.Errorf("messages should be relayed once in order, got %v", ids)
+	}
+
+	stop()
+	time.Sleep(5 * relay.Interval) // A poll in progress finishes
+	if err := adapter.GetDB().Create(&testOutbox{Outbox{TaskID: "task1", Body: "late"}}).Error; err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * relay.Interval)
+	if ids := relayed(); len(ids) != len(taskIDs) {
+		t.Errorf("stopped relay should not publish, got %v", ids)
+	}
+}
@@ -0,0 +1,157 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	. "github.com/HEUDavid/go-fsm/pkg/mq"
+	"github.com/HEUDavid/go-fsm/pkg/util"
+)
+
+// IRoute is a Worker hosted by a Router, implemented by *Worker[Data] of any Data type
+type IRoute interface {
+	GetFSMName() string
+	// InitRoute Initializes the DB of the Worker, the MQ is owned by the Router
+	InitRoute(q IMQ)
+	Handle(msg Message) error
+	CloseDB() error
+}
+
+type IRouter interface {
+	Init()
+	Run(c context.Context)
+	Shutdown(c context.Context) error
+	Handle(msg Message) error
+}
+
+// Router serves several FSMs, possibly with different Data types, from one MQ and one pool of goroutines.
+// A message is dispatched by the FSM of its envelope, or else by the task Type, to the Worker of that FSM.
+// Messages without either, e.g. bare task IDs, go to the Default Worker if set.
+type Router struct {
+	Config *util.Config
+	IMQ
+	ReInit        func()
+	ReRun         func(c context.Context)
+	ReShutdown    func(c context.Context) error
+	ReHandle      func(msg Message) error
+	MaxGoroutines int
+	Default       IRoute // Optional
+	DEBUG         bool
+
+	routes []IRoute
+	fsms   map[string]IRoute // FSM name -> Worker
+	types  map[string]IRoute // Task Type -> Worker
+
+	runner
+}
+
+func (r *Router) RegisterMQ(mq IMQ) {
+	r.IMQ = mq
+}
+
+// RegisterRoute Hosts the Worker, messages of its FSM and of the given task types are dispatched to it
+func (r *Router) RegisterRoute(route IRoute, types ...string) {
+	if r.fsms == nil {
+		r.fsms, r.types = map[string]IRoute{}, map[string]IRoute{}
+	}
+	if _, exist := r.fsms[route.GetFSMName()]; exist {
+		panic(fmt.Sprintf("[FSM] Route %s registered twice", route.GetFSMName()))
+	}
+	r.fsms[route.GetFSMName()] = route
+	for _, t := range types {
+		if _, exist := r.types[t]; exist {
+			panic(fmt.Sprintf("[FSM] Route of type %s registered twice", t))
+		}
+		r.types[t] = route
+	}
+	r.routes = append(r.routes, route)
+}
+
+func (r *Router) Init() {
+	if r.ReInit != nil {
+		r.ReInit()
+		return
+	}
+
+	if prefetch, ok := r.IMQ.(IPrefetch); ok && r.MaxGoroutines > 0 {
+		prefetch.SetPrefetch(r.MaxGoroutines)
+	}
+	if err := r.InitMQ((*r.Config)[r.GetMQSection()].(util.Config)); err != nil {
+		panic(err)
+	}
+
+	for _, route := range r.routes {
+		route.InitRoute(r.IMQ)
+	}
+
+	r.IMQ.Start() // Start Consumer
+}
+
+// Run Fetches and dispatches messages in the background until c is done or Shutdown is called
+func (r *Router) Run(c context.Context) {
+	if r.ReRun != nil {
+		r.ReRun(c)
+		return
+	}
+
+	r.run(c, r.MaxGoroutines, r.IMQ, r.Handle, r.DEBUG)
+}
+
+// Shutdown Stops fetching and waits for the in-flight messages until c is done,
+// the unfinished ones are nacked, then the MQ and the DBs of all Workers are closed.
+func (r *Router) Shutdown(c context.Context) error {
+	if r.ReShutdown != nil {
+		return r.ReShutdown(c)
+	}
+
+	err := r.shutdown(c)
+	r.IMQ.Stop()
+	for _, route := range r.routes {
+		if e := route.CloseDB(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Handle Dispatches the message to its Worker, a message no Worker serves is dropped
+func (r *Router) Handle(msg Message) error {
+	if r.ReHandle != nil {
+		return r.ReHandle(msg)
+	}
+
+	route, err := r.route(msg)
+	if err != nil {
+		log.Printf("[FSM] drop message %s: %v", msg.Body, err)
+		if msg.Ack != nil {
+			if e := msg.Ack(); e != nil {
+				log.Printf("[FSM] ACK %s Err: %v", msg.Body, e)
+			}
+		}
+		return nil
+	}
+	return route.Handle(msg)
+}
+
+func (r *Router) route(msg Message) (IRoute, error) {
+	envelope, err := DecodeEnvelope(msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	if envelope.FSM != "" {
+		if route, ok := r.fsms[envelope.FSM]; ok {
+			return route, nil
+		}
+		return nil, fmt.Errorf("no route of FSM %s", envelope.FSM)
+	}
+	if envelope.Type != "" {
+		if route, ok := r.types[envelope.Type]; ok {
+			return route, nil
+		}
+	}
+	if r.Default != nil {
+		return r.Default, nil
+	}
+	return nil, fmt.Errorf("no route")
+}
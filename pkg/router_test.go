@@ -0,0 +1,131 @@
+package pkg
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/HEUDavid/go-fsm/pkg/db/sqlite"
+	. "github.com/HEUDavid/go-fsm/pkg/metadata"
+	"github.com/HEUDavid/go-fsm/pkg/mq/memory"
+	"github.com/HEUDavid/go-fsm/pkg/util"
+)
+
+type orderData struct {
+	TaskID string `gorm:"primaryKey;column:task_id;type:char(32)"`
+	Item   string `gorm:"column:item"`
+}
+
+func (d *orderData) TableName() string       { return "order_data" }
+func (d *orderData) SetTaskID(taskID string) { d.TaskID = taskID }
+
+type orderTask struct{ Task[*orderData] }
+
+func (t *orderTask) TableName() string { return "order_task" }
+
+type orderUniqueRequest struct {
+	RequestID string `gorm:"primaryKey;column:request_id;type:char(32)"`
+	TaskID    string `gorm:"column:task_id;type:char(32)"`
+}
+
+func (u *orderUniqueRequest) TableName() string { return "order_unique_request" }
+
+func orderFSM() FSM[*orderData] {
+	placed := GenState[*orderData]("Placed", false, func(task *Task[*orderData]) error {
+		task.State = "Shipped"
+		return nil
+	})
+	shipped := GenState[*orderData]("Shipped", true, nil)
+	fsm := GenFSM[*orderData]("OrderFSM")
+	fsm.RegisterState(placed, shipped)
+	fsm.RegisterTransition(GenTransition(placed, shipped))
+	return fsm
+}
+
+func TestRouter(t *testing.T) {
+	c := context.Background()
+	config := &util.Config{
+		"sqlite":       util.Config{"path": filepath.Join(t.TempDir(), "fsm.db")},
+		"sqlite_order": util.Config{"path": filepath.Join(t.TempDir(), "order.db")},
+		"memory":       util.Config{},
+	}
+	queue := &memory.Factory{Section: "memory"}
+
+	payAdapter := &Adapter[*testData]{}
+	payWorker := &Worker[*testData]{}
+	payAdapter.Config, payWorker.Config = config, config
+	payAdapter.RegisterModel(&testData{}, &testTask{}, &testUniqueRequest{})
+	payWorker.RegisterModel(&testData{}, &testTask{}, &testUniqueRequest{})
+	payAdapter.RegisterDB(&sqlite.Factory{Section: "sqlite"})
+	payWorker.RegisterDB(&sqlite.Factory{Section: "sqlite"})
+	payAdapter.RegisterMQ(queue)
+	payAdapter.RegisterFSM(testFSM())
+	payWorker.RegisterFSM(testFSM())
+	payAdapter.RegisterGenerator(util.UniqueID)
+	payWorker.RegisterGenerator(util.UniqueID)
+
+	orderAdapter := &Adapter[*orderData]{}
+	orderWorker := &Worker[*orderData]{}
+	orderAdapter.Config, orderWorker.Config = config, config
+	orderAdapter.RegisterModel(&orderData{}, &orderTask{}, &orderUniqueRequest{})
+	orderWorker.RegisterModel(&orderData{}, &orderTask{}, &orderUniqueRequest{})
+	orderAdapter.RegisterDB(&sqlite.Factory{Section: "sqlite_order"})
+	orderWorker.RegisterDB(&sqlite.Factory{Section: "sqlite_order"})
+	orderAdapter.RegisterMQ(queue)
+	orderAdapter.RegisterFSM(orderFSM())
+	orderWorker.RegisterFSM(orderFSM())
+	orderAdapter.RegisterGenerator(util.UniqueID)
+	orderWorker.RegisterGenerator(util.UniqueID)
+
+	// The adapters init the shared queue and the tables before the router starts fetching
+	for _, adapter := range []interface{ Init() error }{payAdapter, orderAdapter} {
+		if err := adapter.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := payAdapter.GetDB().AutoMigrate(&testData{}, &testTask{}, &testUniqueRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := orderAdapter.GetDB().AutoMigrate(&orderData{}, &orderTask{}, &orderUniqueRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	router := &Router{Config: config, MaxGoroutines: 4}
+	router.RegisterMQ(queue)
+	router.RegisterRoute(payWorker)
+	router.RegisterRoute(orderWorker, "order")
+	router.Init()
+	router.Run(c)
+
+	pay := GenTaskInstance(util.UniqueID(), "", &testData{Amount: 100})
+	pay.Type, pay.State = "pay", "New"
+	if err := payAdapter.Create(c, pay); err != nil {
+		t.Fatal(err)
+	}
+	order := GenTaskInstance(util.UniqueID(), "", &orderData{Item: "book"})
+	order.Type, order.State = "order", "Placed"
+	if err := orderAdapter.Create(c, order); err != nil {
+		t.Fatal(err)
+	}
+	_ = queue.PublishMessage(c, order.ID) // A bare task ID without Default is dropped
+
+	waitCtx, cancel := context.WithTimeout(c, 5*time.Second)
+	defer cancel()
+	if err := queue.WaitIdle(waitCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := payAdapter.Query(c, pay); err != nil || pay.State != "End" {
+		t.Errorf("unexpected pay task: %s, %v", util.Pretty(pay), err)
+	}
+	if err := orderAdapter.Query(c, order); err != nil || order.State != "Shipped" {
+		t.Errorf("unexpected order task: %s, %v", util.Pretty(order), err)
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(c, time.Second)
+	defer cancelShutdown()
+	if err := router.Shutdown(shutdownCtx); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,108 @@
+package pkg
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	. "github.com/HEUDavid/go-fsm/pkg/mq"
+)
+
+// runner Fetches and handles messages with at most maxGoroutines goroutines, shared by Worker and Router
+type runner struct {
+	stop     context.CancelFunc // Stops fetching
+	abort    context.CancelFunc // Cancels the in-flight messages
+	done     chan struct{}      // Closed when all the in-flight messages are handled
+	inflight sync.Map           // In-flight message -> its Nack
+}
+
+func (r *runner) run(c context.Context, maxGoroutines int, q IMQ, handle func(msg Message) error, debug bool) {
+	fetchCtx, stop := context.WithCancel(c)
+	handleCtx, abort := context.WithCancel(context.WithoutCancel(c))
+	r.stop, r.abort, r.done = stop, abort, make(chan struct{})
+
+	go func() {
+		defer close(r.done)
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, maxGoroutines)
+		for {
+			select {
+			case sem <- struct{}{}:
+			case <-fetchCtx.Done():
+				wg.Wait()
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				msg := q.FetchMessage(fetchCtx)
+				if msg.Body == "" { // Stopped
+					return
+				}
+				if debug {
+					log.Printf("[FSM] fetch msg %s", msg.Body)
+				}
+
+				msg, release := r.track(handleCtx, msg)
+				defer release()
+				if err := handle(msg); err != nil {
+					log.Printf("[FSM] handle %s Err: %v", msg.Body, err)
+				}
+			}()
+		}
+	}()
+}
+
+// track Registers an in-flight message, its Ack and Nack take effect only once,
+// and its context is canceled when the Shutdown deadline is exceeded.
+func (r *runner) track(handleCtx context.Context, msg Message) (Message, func()) {
+	var once sync.Once
+	settle := func(f func() error) func() error {
+		return func() (err error) {
+			once.Do(func() {
+				if f != nil {
+					err = f()
+				}
+			})
+			return err
+		}
+	}
+
+	c, cancel := context.WithCancel(msg.C)
+	stopAfter := context.AfterFunc(handleCtx, cancel)
+	msg.C = c
+	msg.Ack = settle(msg.Ack)
+	msg.Nack = settle(msg.Nack)
+
+	key := &msg
+	r.inflight.Store(key, msg.Nack)
+	return msg, func() {
+		r.inflight.Delete(key)
+		stopAfter()
+		cancel()
+	}
+}
+
+// shutdown Stops fetching and waits for the in-flight messages until c is done, the unfinished ones are nacked
+func (r *runner) shutdown(c context.Context) error {
+	if r.stop == nil { // Not running
+		return nil
+	}
+
+	r.stop()
+	select {
+	case <-r.done:
+		return nil
+	case <-c.Done():
+	}
+	r.abort()
+	r.inflight.Range(func(key, nack any) bool {
+		if e := nack.(func() error)(); e != nil {
+			log.Printf("[FSM] NACK %s Err: %v", key.(*Message).Body, e)
+		}
+		return true
+	})
+	return c.Err()
+}
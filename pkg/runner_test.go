@@ -0,0 +1,49 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/HEUDavid/go-fsm/pkg/mq"
+	"github.com/HEUDavid/go-fsm/pkg/mq/memory"
+	"github.com/HEUDavid/go-fsm/pkg/util"
+)
+
+func TestShutdownNacksInflight(t *testing.T) {
+	c := context.Background()
+	queue := &memory.Factory{}
+	if err := queue.InitMQ(util.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	_ = queue.PublishMessage(c, "task1")
+
+	started, canceled := make(chan struct{}), make(chan struct{})
+	r := &runner{}
+	r.run(c, 1, queue, func(msg Message) error {
+		close(started)
+		<-msg.C.Done() // Longer than the Shutdown deadline
+		close(canceled)
+		return msg.Nack()
+	}, false)
+	<-started
+
+	shutdownCtx, cancel := context.WithTimeout(c, 50*time.Millisecond)
+	defer cancel()
+	if err := r.shutdown(shutdownCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected shutdown error: %v", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("the context of the in-flight message should be canceled")
+	}
+	<-r.done
+	if stats := queue.Stats(); stats.Nacked != 1 || stats.Acked != 0 {
+		t.Errorf("the in-flight message should be nacked once, stats: %+v", stats)
+	}
+	if ready, _, _ := queue.Len(); ready != 1 {
+		t.Errorf("the nacked message should be ready again, got %d", ready)
+	}
+}
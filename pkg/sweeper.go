@@ -0,0 +1,152 @@
+package pkg
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/HEUDavid/go-fsm/internal"
+	. "github.com/HEUDavid/go-fsm/pkg/metadata"
+	"github.com/HEUDavid/go-fsm/pkg/mq"
+	"github.com/HEUDavid/go-fsm/pkg/util"
+)
+
+type ISweeper[Data DataEntity] interface {
+	Init()
+	Run(c context.Context)
+	Sweep(c context.Context) (int, error)
+}
+
+// Sweeper re-publishes tasks staying in a non-final state for too long,
+// e.g. the message was lost, or the publishing failed after the task was committed.
+// Multiple sweepers can run at the same time, each stuck task is claimed by one of them.
+type Sweeper[Data DataEntity] struct {
+	internal.Base[Data]
+	ReInit     func()
+	ReRun      func(c context.Context)
+	ReSweep    func(c context.Context) (int, error)
+	Interval   time.Duration            // Scan interval, default 1 minute
+	Threshold  time.Duration            // Stay of a state before its tasks are re-driven, default 5 minutes, plus the MaxBackoff of a retried state
+	Thresholds map[string]time.Duration // Per state Threshold, overrides the default including the retry backoff
+	BatchSize  int                      // Max tasks of a state re-driven per scan, default 100
+}
+
+func (s *Sweeper[Data]) Init() {
+	if s.ReInit != nil {
+		s.ReInit()
+		return
+	}
+
+	if err := s.InitDB((*s.Config)[s.GetDBSection()].(util.Config)); err != nil {
+		panic(err)
+	}
+
+	if err := s.InitMQ((*s.Config)[s.GetMQSection()].(util.Config)); err != nil {
+		panic(err)
+	}
+}
+
+// Run Sweeps periodically in the background until c is done
+func (s *Sweeper[Data]) Run(c context.Context) {
+	if s.ReRun != nil {
+		s.ReRun(c)
+		return
+	}
+
+	interval := s.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-c.Done():
+				return
+			}
+			n, err := s.Sweep(c)
+			if err != nil {
+				log.Printf("[FSM] sweep Err: %v", err)
+			}
+			if n > 0 {
+				log.Printf("[FSM] sweep %d tasks", n)
+			}
+		}
+	}()
+}
+
+// Sweep Re-publishes the stuck tasks of all non-final states, returns the number of tasks re-driven
+func (s *Sweeper[Data]) Sweep(c context.Context) (int, error) {
+	if s.ReSweep != nil {
+		return s.ReSweep(c)
+	}
+
+	limit := s.BatchSize
+	if limit <= 0 {
+		limit = 100
+	}
+
+	count := 0
+	for _, state := range s.nonFinalStates() {
+		before := time.Now().Add(-s.threshold(state))
+		taskIDs, err := internal.ClaimStuckTasks(c, s.GetDB(), s.Models, state, before, limit)
+		for _, taskID := range taskIDs {
+			envelope := &mq.Envelope{TaskID: taskID, FSM: s.FSM.Name, State: state, EnqueueTime: time.Now()}
+			if e := s.PublishMessage(c, envelope.Encode()); e != nil {
+				return count, e
+			}
+			if s.DEBUG {
+				log.Printf("[FSM] sweep task %s %s", taskID, state)
+			}
+			count++
+		}
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func (s *Sweeper[Data]) threshold(state string) time.Duration {
+	if t, ok := s.Thresholds[state]; ok {
+		return t
+	}
+	threshold := s.Threshold
+	if threshold <= 0 {
+		threshold = 5 * time.Minute
+	}
+	// A failed attempt touches the task, which then waits up to the backoff for the delayed message
+	if registered, ok := s.FSM.GetState(state); ok && registered.Retry != nil {
+		threshold += registered.Retry.MaxBackoff()
+	}
+	return threshold
+}
+
+// nonFinalStates States registered or referenced by transitions, which are not final
+func (s *Sweeper[Data]) nonFinalStates() []string {
+	seen := map[string]bool{}
+	var states []string
+	add := func(state State[Data]) {
+		if seen[state.GetName()] {
+			return
+		}
+		seen[state.GetName()] = true
+		if registered, ok := s.FSM.GetState(state.GetName()); ok {
+			state = registered
+		}
+		if !state.IsFinalState() {
+			states = append(states, state.GetName())
+		}
+	}
+	for _, state := range s.FSM.States {
+		add(state)
+	}
+	for _, transition := range s.FSM.Transitions {
+		add(transition.From)
+		add(transition.To)
+	}
+	return states
+}
@@ -0,0 +1,83 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/HEUDavid/go-fsm/pkg/db/sqlite"
+	. "github.com/HEUDavid/go-fsm/pkg/metadata"
+	"github.com/HEUDavid/go-fsm/pkg/mq"
+	"github.com/HEUDavid/go-fsm/pkg/util"
+)
+
+func TestSweep(t *testing.T) {
+	c := context.Background()
+	adapter, _, queue := setup(t)
+	queue.RecordPublished = true
+
+	sweeper := &Sweeper[*testData]{}
+	sweeper.Config = adapter.Config
+	sweeper.RegisterModel(&testData{}, &testTask{}, &testUniqueRequest{})
+	sweeper.RegisterDB(&sqlite.Factory{Section: "sqlite"})
+	sweeper.RegisterMQ(queue)
+	sweeper.RegisterFSM(testFSM())
+	sweeper.FSM.States["Pay"] = testPay.WithRetry(RetryPolicy{BaseDelay: time.Minute}) // Backoff up to DefaultMaxDelay
+	sweeper.Init()
+
+	cases := []struct {
+		state string
+		stay  time.Duration
+		swept bool
+	}{
+		{"New", 10 * time.Minute, true},
+		{"New", time.Minute, false},
+		{"Pay", 30 * time.Minute, false}, // May be waiting for its retry
+		{"Pay", 2 * time.Hour, true},
+		{"End", 2 * time.Hour, false},
+	}
+	taskIDs := map[string]int{}
+	for i, s := range cases {
+		task := GenTaskInstance(util.UniqueID(), "", &testData{Amount: 100})
+		task.Type = "test"
+		task.State = testNew.GetName()
+		if err := adapter.Create(c, task); err != nil {
+			t.Fatal(err)
+		}
+		if err := adapter.GetDB().Table("task").Where("id = ?", task.ID).
+			Updates(map[string]interface{}{"state": s.state, "update_time": time.Now().Add(-s.stay)}).Error; err != nil {
+			t.Fatal(err)
+		}
+		taskIDs[task.ID] = i
+	}
+	published := len(queue.Published())
+
+	n, err := sweeper.Sweep(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swept := map[int]bool{}
+	for _, msg := range queue.Published()[published:] {
+		envelope, err := mq.DecodeEnvelope(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i := taskIDs[envelope.TaskID]
+		if envelope.State != cases[i].state || envelope.FSM != "TestFSM" {
+			t.Errorf("unexpected message %s", msg)
+		}
+		swept[i] = true
+	}
+	for i, s := range cases {
+		if swept[i] != s.swept {
+			t.Errorf("task in %s for %s swept: %v", s.state, s.stay, swept[i])
+		}
+	}
+	if n != 2 {
+		t.Errorf("expected 2 tasks swept, got %d", n)
+	}
+
+	if n, _ = sweeper.Sweep(c); n != 0 { // Claimed by the first sweep
+		t.Errorf("tasks should be swept once per threshold, got %d", n)
+	}
+}
@@ -2,8 +2,10 @@ package pkg
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
-	"sync"
+	"reflect"
 
 	"github.com/HEUDavid/go-fsm/internal"
 	. "github.com/HEUDavid/go-fsm/pkg/metadata"
@@ -13,16 +15,20 @@ import (
 
 type IWorker[Data DataEntity] interface {
 	Init()
-	Run()
+	Run(c context.Context)
+	Shutdown(c context.Context) error
 	Handle(msg Message) error
 }
 
 type Worker[Data DataEntity] struct {
 	internal.Base[Data]
 	ReInit        func()
-	ReRun         func()
+	ReRun         func(c context.Context)
+	ReShutdown    func(c context.Context) error
 	ReHandle      func(msg Message) error
 	MaxGoroutines int
+
+	runner
 }
 
 func (w *Worker[Data]) Init() {
@@ -31,10 +37,19 @@ func (w *Worker[Data]) Init() {
 		return
 	}
 
+	if err := w.FSM.Validate().Err(); err != nil {
+		panic(err)
+	}
+	if err := w.CheckTxPublish(); err != nil {
+		panic(err)
+	}
 	if err := w.InitDB((*w.Config)[w.GetDBSection()].(util.Config)); err != nil {
 		panic(err)
 	}
 
+	if prefetch, ok := w.IMQ.(IPrefetch); ok && w.MaxGoroutines > 0 {
+		prefetch.SetPrefetch(w.MaxGoroutines)
+	}
 	if err := w.InitMQ((*w.Config)[w.GetMQSection()].(util.Config)); err != nil {
 		panic(err)
 	}
@@ -42,30 +57,47 @@ func (w *Worker[Data]) Init() {
 	w.IMQ.Start() // Start Consumer
 }
 
-func (w *Worker[Data]) Run() {
+// InitRoute Initializes the Worker hosted by a Router, which owns the MQ
+func (w *Worker[Data]) InitRoute(q IMQ) {
+	if err := w.FSM.Validate().Err(); err != nil {
+		panic(err)
+	}
+	if err := w.InitDB((*w.Config)[w.GetDBSection()].(util.Config)); err != nil {
+		panic(err)
+	}
+	w.RegisterMQ(q)
+	if err := w.CheckTxPublish(); err != nil {
+		panic(err)
+	}
+}
+
+func (w *Worker[Data]) GetFSMName() string {
+	return w.FSM.Name
+}
+
+// Run Fetches and handles messages in the background until c is done or Shutdown is called
+func (w *Worker[Data]) Run(c context.Context) {
 	if w.ReRun != nil {
-		w.ReRun()
+		w.ReRun(c)
 		return
 	}
 
-	go func() {
-		var wg sync.WaitGroup
-		sem := make(chan struct{}, w.MaxGoroutines)
-		for {
-			sem <- struct{}{}
-			wg.Go(func() {
-				defer func() { <-sem }()
+	w.run(c, w.MaxGoroutines, w.IMQ, w.Handle, w.DEBUG)
+}
 
-				msg := w.FetchMessage(context.Background())
-				if w.DEBUG {
-					log.Printf("[FSM] fetch msg %s", msg.Body)
-				}
-				if err := w.Handle(msg); err != nil {
-					log.Printf("[FSM] handle %s Err: %v", msg.Body, err)
-				}
-			})
-		}
-	}()
+// Shutdown Stops fetching and waits for the in-flight messages until c is done,
+// the unfinished ones are nacked, then the MQ and DB are closed.
+func (w *Worker[Data]) Shutdown(c context.Context) error {
+	if w.ReShutdown != nil {
+		return w.ReShutdown(c)
+	}
+
+	err := w.shutdown(c)
+	w.IMQ.Stop()
+	if e := w.CloseDB(); e != nil && err == nil {
+		err = e
+	}
+	return err
 }
 
 func (w *Worker[Data]) Handle(msg Message) (err error) {
@@ -73,8 +105,9 @@ func (w *Worker[Data]) Handle(msg Message) (err error) {
 		return w.ReHandle(msg)
 	}
 
+	var settled bool // The task has been published again with a delay, the message can be acked
 	defer func() {
-		if err != nil {
+		if err != nil && !settled {
 			if msg.Nack != nil {
 				if e := msg.Nack(); e != nil {
 					log.Printf("[FSM] NACK %s Err: %v", msg.Body, e)
@@ -89,14 +122,38 @@ func (w *Worker[Data]) Handle(msg Message) (err error) {
 		}
 	}()
 
+	envelope, err := DecodeEnvelope(msg.Body)
+	if err != nil {
+		log.Printf("[FSM] drop malformed message %s: %v", msg.Body, err)
+		return nil
+	}
+	if envelope.FSM != "" && envelope.FSM != w.FSM.Name {
+		log.Printf("[FSM] drop message of FSM %s, task %s", envelope.FSM, envelope.TaskID)
+		return nil
+	}
+	if envelope.State != "" { // Dropped without reading the DB
+		if expected, exist := w.FSM.GetState(envelope.State); !exist || expected.IsFinalState() {
+			return nil
+		}
+	}
+
 	c := msg.C
-	taskID := msg.Body
+	if w.Propagator != nil {
+		c = w.Propagator.Extract(c, envelope.Headers)
+	}
+	taskID := envelope.TaskID
 
 	state, err := internal.QueryTaskState(c, w.GetDB(), w.Models, taskID)
 	if err != nil {
 		log.Printf("[FSM] query task %s %s Err: %v", taskID, *state, err)
 		return err
 	}
+	if envelope.State != "" && envelope.State != *state { // The task has moved on, a newer message was published
+		if w.DEBUG {
+			log.Printf("[FSM] drop stale message of task %s %s, current %s", taskID, envelope.State, *state)
+		}
+		return nil
+	}
 
 	handler, exist := w.FSM.GetState(*state)
 	if !exist {
@@ -113,21 +170,36 @@ func (w *Worker[Data]) Handle(msg Message) (err error) {
 	if err = internal.QueryTask(c, w.Models, task); err != nil {
 		return err
 	}
+	if envelope.Version != 0 && task.Version > envelope.Version {
+		if w.DEBUG {
+			log.Printf("[FSM] drop stale message of task %s version %d, current %d", taskID, envelope.Version, task.Version)
+		}
+		return nil
+	}
 
 	if w.DEBUG {
 		log.Printf("[FSM] load task %s %s %s", task.ID, task.State, util.Pretty(task))
 	}
-	if err = handler.Handle(task); err != nil {
+	if err = w.runHandler(c, handler, task); err != nil {
+		settled, err = w.reschedule(c, handler, task, err)
 		return err
 	}
 
 	task.RequestID = w.GenID()
-	if err = internal.UpdateTask(c, w.Models, task, w.FSM); err != nil {
+	version, attempt := task.Version, task.Attempt
+	if err = internal.UpdateTask(c, w.Models, task, w.FSM, w.TxHooks()...); err != nil {
+		if !rejected(err) {
+			return err
+		}
+		task.Version, task.Attempt = version, attempt // Rolled back
+		settled, err = w.reject(c, handler, task, err)
 		return err
 	}
 
-	if err = w.PublishMessage(c, taskID); err != nil {
-		return err
+	if !w.PublishedInTx() {
+		if err = w.PublishMessage(c, w.GenMessage(c, task)); err != nil {
+			return err
+		}
 	}
 
 	if w.DEBUG {
@@ -135,3 +207,144 @@ func (w *Worker[Data]) Handle(msg Message) (err error) {
 	}
 	return nil
 }
+
+// runHandler Runs the state handler with the message context, the Timeout of the state is enforced
+// even if the handler ignores the context, then the task is left untouched. The handler works on a copy of
+// the task and of its Data struct, a handler running on after the timeout should not write to the values
+// they refer to (e.g. slices or maps of Data), so handlers should return once the context is done.
+func (w *Worker[Data]) runHandler(c context.Context, state State[Data], task *Task[Data]) error {
+	if state.Timeout <= 0 {
+		return state.HandleContext(c, task)
+	}
+
+	c, cancel := context.WithTimeout(c, state.Timeout)
+	defer cancel()
+
+	t := *task
+	t.Data = cloneData(task.Data)
+	done := make(chan error, 1)
+	go func() { done <- state.HandleContext(c, &t) }()
+
+	select {
+	case err := <-done:
+		*task = t
+		return err
+	case <-c.Done():
+		return fmt.Errorf("handler of %s: %w", state.GetName(), c.Err())
+	}
+}
+
+// cloneData Copies the struct data points to
+func cloneData[Data DataEntity](data Data) Data {
+	v := reflect.ValueOf(data)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return data
+	}
+	clone := reflect.New(v.Elem().Type())
+	clone.Elem().Set(v.Elem())
+	return clone.Interface().(Data)
+}
+
+// reschedule Publishes the task again with a delay instead of letting the MQ redeliver it at once.
+// It reports whether the message is settled, and the error to be returned by Handle.
+func (w *Worker[Data]) reschedule(c context.Context, state State[Data], task *Task[Data], handleErr error) (bool, error) {
+	// The handler may have modified the task before failing
+	again := *task
+	again.State = state.GetName()
+
+	var delayErr *DelayError
+	if errors.As(handleErr, &delayErr) {
+		if err := w.PublishDelayMessage(c, w.GenMessage(c, &again), delayErr.Delay); err != nil {
+			return false, err
+		}
+		if w.DEBUG {
+			log.Printf("[FSM] task %s %s run again in %s", task.ID, state.GetName(), delayErr.Delay)
+		}
+		return true, nil
+	}
+
+	if state.Retry == nil {
+		return false, handleErr
+	}
+
+	ok, err := internal.IncrTaskAttempt(c, w.GetDB(), w.Models, task.ID, task.Version)
+	if err != nil {
+		return false, err
+	}
+	if !ok { // The task has been updated by others, nothing to retry
+		return true, handleErr
+	}
+	attempt := task.Attempt + 1
+	if state.Retry.Exhausted(attempt) {
+		settled, err := w.deadLetter(c, state, task, attempt, handleErr)
+		if err != nil {
+			return false, err
+		}
+		return settled, fmt.Errorf("attempt %d exhausted: %w", attempt, handleErr)
+	}
+
+	delay := state.Retry.Backoff(attempt)
+	again.Attempt = attempt
+	if err = w.PublishDelayMessage(c, w.GenMessage(c, &again), delay); err != nil {
+		return false, err
+	}
+	return true, fmt.Errorf("attempt %d, retry in %s: %w", attempt, delay, handleErr)
+}
+
+// rejected Whether the update was rejected by a guard or failed by a callback, which handling the message
+// again at once would most likely repeat
+func rejected(err error) bool {
+	var guardErr *GuardError
+	var callbackErr *CallbackError
+	return errors.As(err, &guardErr) || errors.As(err, &callbackErr)
+}
+
+// reject Retries the task like a failed handler if the state has a RetryPolicy, or else gives it up and settles the message
+func (w *Worker[Data]) reject(c context.Context, state State[Data], task *Task[Data], updateErr error) (bool, error) {
+	if state.Retry != nil {
+		return w.reschedule(c, state, task, updateErr)
+	}
+	log.Printf("[FSM] give up task %s %s, Err: %v", task.ID, state.GetName(), updateErr)
+	return true, updateErr
+}
+
+// deadLetter Moves the task into the dead letter state of the FSM and/or records it in the dead letter table.
+// If neither is configured the task is left in its state and the message is settled, the Sweeper may pick it up.
+func (w *Worker[Data]) deadLetter(c context.Context, state State[Data], task *Task[Data], attempts uint, handleErr error) (bool, error) {
+	deadLetter, toDeadLetter := w.FSM.GetDeadLetter()
+	if !toDeadLetter && w.DeadLetterModel == nil {
+		log.Printf("[FSM] give up task %s %s, attempts: %d, Err: %v", task.ID, state.GetName(), attempts, handleErr)
+		return true, nil
+	}
+
+	// Reload the task, the handler may have modified it before failing
+	data, _ := util.Assert[Data](util.ReflectNew(w.DataModel))
+	current := GenTaskInstance("", task.ID, data)
+	current.WithDB = w.GetDB()
+	if err := internal.QueryTask(c, w.Models, current); err != nil {
+		return false, err
+	}
+
+	stateTime, err := internal.QueryStateTime(c, w.GetDB(), w.Models, current.ID, state.GetName(), current.Version)
+	if err != nil {
+		return false, err
+	}
+	letter := &DeadLetter{
+		TaskID:    current.ID,
+		State:     state.GetName(),
+		Version:   current.Version,
+		Attempts:  attempts,
+		LastError: handleErr.Error(),
+		StateTime: stateTime,
+	}
+	current.RequestID = w.GenID()
+	if toDeadLetter {
+		current.State = deadLetter.GetName()
+	}
+	if err = internal.DeadLetterTask(c, w.Models, current, w.FSM, toDeadLetter, letter); err != nil {
+		return false, err
+	}
+
+	log.Printf("[FSM] dead letter task %s %s -> %s, attempts: %d, Err: %v", current.ID, state.GetName(), current.State, attempts, handleErr)
+	return true, nil
+}
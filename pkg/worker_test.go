@@ -0,0 +1,438 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/HEUDavid/go-fsm/pkg/db/sqlite"
+	. "github.com/HEUDavid/go-fsm/pkg/metadata"
+	"github.com/HEUDavid/go-fsm/pkg/mq"
+	"github.com/HEUDavid/go-fsm/pkg/mq/memory"
+	"github.com/HEUDavid/go-fsm/pkg/util"
+	"gorm.io/gorm"
+)
+
+type testData struct {
+	TaskID  string `gorm:"primaryKey;column:task_id;type:char(32)"`
+	Comment string `gorm:"column:comment"`
+	Amount  int    `gorm:"column:amount"`
+}
+
+func (d *testData) TableName() string       { return "data" }
+func (d *testData) SetTaskID(taskID string) { d.TaskID = taskID }
+
+type testTask struct{ Task[*testData] }
+
+func (t *testTask) TableName() string { return "task" }
+
+type testUniqueRequest struct {
+	RequestID string `gorm:"primaryKey;column:request_id;type:char(32)"`
+	TaskID    string `gorm:"column:task_id;type:char(32)"`
+}
+
+func (u *testUniqueRequest) TableName() string { return "unique_request" }
+
+type testTaskFlow struct{ TaskFlow }
+
+func (f *testTaskFlow) TableName() string { return "task_flow" }
+
+type testDataFlow struct {
+	ID      uint64 `gorm:"primaryKey;autoIncrement"`
+	TaskID  string `gorm:"column:task_id"`
+	Comment string `gorm:"column:comment"`
+	Amount  int    `gorm:"column:amount"`
+	Version uint   `gorm:"column:version"`
+}
+
+func (f *testDataFlow) TableName() string { return "data_flow" }
+
+type testDeadLetter struct{ DeadLetter }
+
+func (d *testDeadLetter) TableName() string { return "dead_letter" }
+
+var (
+	testNew = GenState[*testData]("New", false, func(task *Task[*testData]) error {
+		task.Data.Comment = "Modified by New"
+		task.State = "Pay"
+		return nil
+	})
+	testPay = GenContextState[*testData]("Pay", false, func(c context.Context, task *Task[*testData]) error {
+		if task.Data.Amount < 0 {
+			return fmt.Errorf("pay %d failed", task.Data.Amount)
+		}
+		task.State = "End"
+		return nil
+	}).WithRetry(RetryPolicy{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond})
+	testEnd    = GenState[*testData]("End", true, nil)
+	testFailed = GenState[*testData]("Failed", true, nil)
+)
+
+func testFSM() FSM[*testData] {
+	fsm := GenFSM[*testData]("TestFSM")
+	fsm.RegisterState(testNew, testPay, testEnd)
+	fsm.RegisterInitialState(testNew)
+	fsm.RegisterDeadLetter(testFailed)
+	fsm.RegisterTransition(
+		GenTransition(testNew, testPay),
+		GenTransition(testPay, testEnd),
+		GenTransition(testPay, testFailed),
+	)
+	return fsm
+}
+
+func setup(t *testing.T) (*Adapter[*testData], *Worker[*testData], *memory.Factory) {
+	config := &util.Config{
+		"sqlite": util.Config{"path": filepath.Join(t.TempDir(), "fsm.db")},
+		"memory": util.Config{},
+	}
+	queue := &memory.Factory{Section: "memory"}
+
+	adapter := &Adapter[*testData]{}
+	worker := &Worker[*testData]{MaxGoroutines: 4}
+	adapter.Config, worker.Config = config, config
+	adapter.RegisterModel(&testData{}, &testTask{}, &testUniqueRequest{})
+	worker.RegisterModel(&testData{}, &testTask{}, &testUniqueRequest{})
+	adapter.RegisterDeadLetterModel(&testDeadLetter{})
+	worker.RegisterDeadLetterModel(&testDeadLetter{})
+	adapter.RegisterFlowModel(&testTaskFlow{}, &testDataFlow{})
+	worker.RegisterFlowModel(&testTaskFlow{}, &testDataFlow{})
+	adapter.RegisterDB(&sqlite.Factory{Section: "sqlite"})
+	worker.RegisterDB(&sqlite.Factory{Section: "sqlite"})
+	adapter.RegisterMQ(queue)
+	worker.RegisterMQ(queue)
+	adapter.RegisterFSM(testFSM())
+	worker.RegisterFSM(testFSM())
+	adapter.RegisterGenerator(util.UniqueID)
+	worker.RegisterGenerator(util.UniqueID)
+
+	if err := adapter.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := adapter.GetDB().AutoMigrate(&testData{}, &testTask{}, &testUniqueRequest{}, &testDeadLetter{}, &testTaskFlow{}, &testDataFlow{}); err != nil {
+		t.Fatal(err)
+	}
+	worker.Init()
+	return adapter, worker, queue
+}
+
+// createTask Creates a task in New through the Adapter
+func createTask(t *testing.T, adapter *Adapter[*testData], amount int) *Task[*testData] {
+	task := GenTaskInstance(util.UniqueID(), "", &testData{Amount: amount})
+	task.Type = "test"
+	task.State = testNew.GetName()
+	if err := adapter.Create(context.Background(), task); err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
+
+func queryTask(t *testing.T, adapter *Adapter[*testData], taskID string) *Task[*testData] {
+	task := GenTaskInstance("", taskID, &testData{})
+	if err := adapter.Query(context.Background(), task); err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
+
+// handle Handles body as if fetched from the MQ, returns whether the message is acked
+func handle(worker *Worker[*testData], body string) (bool, error) {
+	var acked bool
+	msg := mq.Message{C: context.Background(), Body: body, Ack: func() error { acked = true; return nil }, Nack: func() error { return nil }}
+	err := worker.Handle(msg)
+	return acked, err
+}
+
+func TestWorker(t *testing.T) {
+	c := context.Background()
+	adapter, worker, queue := setup(t)
+	worker.Run(c)
+
+	var taskIDs []string
+	for _, amount := range []int{100, -1} {
+		taskIDs = append(taskIDs, createTask(t, adapter, amount).ID)
+	}
+
+	waitCtx, cancel := context.WithTimeout(c, 5*time.Second)
+	defer cancel()
+	if err := queue.WaitIdle(waitCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	if succ := queryTask(t, adapter, taskIDs[0]); succ.State != "End" || succ.Data.Comment != "Modified by New" {
+		t.Errorf("unexpected task: %s", util.Pretty(succ))
+	}
+
+	fail := queryTask(t, adapter, taskIDs[1])
+	if fail.State != "Failed" {
+		t.Errorf("unexpected task: %s", util.Pretty(fail))
+	}
+	var letter testDeadLetter
+	if err := adapter.GetDB().Table(letter.TableName()).Where("task_id = ?", fail.ID).Take(&letter).Error; err != nil {
+		t.Fatal(err)
+	}
+	if letter.State != "Pay" || letter.Attempts != 3 || letter.LastError != "pay -1 failed" || letter.StateTime == nil {
+		t.Errorf("unexpected dead letter: %s", util.Pretty(letter))
+	}
+	history, err := adapter.QueryTaskHistory(c, fail.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || !history[1].CreateTime.Equal(*letter.StateTime) { // Entered Pay, not touched by the retries
+		t.Errorf("unexpected state time %v of history %s", letter.StateTime, util.Pretty(history))
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(c, time.Second)
+	defer cancelShutdown()
+	if err := worker.Shutdown(shutdownCtx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunHandlerTimeout(t *testing.T) {
+	c := context.Background()
+	_, worker, _ := setup(t)
+
+	late := make(chan struct{})
+	ignoring := GenState[*testData]("Pay", false, func(task *Task[*testData]) error {
+		time.Sleep(100 * time.Millisecond) // Ignores the timeout
+		task.Data.Comment = "late"
+		task.State = "End"
+		close(late)
+		return nil
+	}).WithTimeout(20 * time.Millisecond)
+	task := GenTaskInstance("", util.UniqueID(), &testData{Comment: "before"})
+	task.State = "Pay"
+	if err := worker.runHandler(c, ignoring, task); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	<-late
+	if task.State != "Pay" || task.Data.Comment != "before" {
+		t.Errorf("a timed out handler should leave the task untouched: %s", util.Pretty(task))
+	}
+
+	honoring := GenContextState[*testData]("Pay", false, func(c context.Context, task *Task[*testData]) error {
+		<-c.Done()
+		return c.Err()
+	}).WithTimeout(time.Minute)
+	msgCtx, cancel := context.WithCancel(c)
+	time.AfterFunc(20*time.Millisecond, cancel) // The message is aborted, e.g. on shutdown
+	if err := worker.runHandler(msgCtx, honoring, task); !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestAdapterCreateInitialState(t *testing.T) {
+	c := context.Background()
+	adapter, _, _ := setup(t)
+
+	task := GenTaskInstance(util.UniqueID(), "", &testData{Amount: 100})
+	task.Type = "test"
+	task.State = testPay.GetName()
+	var initialErr *InitialStateError
+	if err := adapter.Create(c, task); !errors.As(err, &initialErr) || initialErr.State != "Pay" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestAdapterUpdateGuard(t *testing.T) {
+	c := context.Background()
+	adapter, _, _ := setup(t)
+	adapter.FSM.RegisterTransition(GenTransition(testNew, testPay).WithGuard("limit",
+		func(c context.Context, current, next *Task[*testData]) bool { return current.Data.Amount < 1000 }),
+	)
+
+	for _, amount := range []int{100, 5000} {
+		task := createTask(t, adapter, amount)
+		next := GenTaskInstance(util.UniqueID(), task.ID, &testData{})
+		next.State, next.Version = testPay.GetName(), task.Version
+		err := adapter.Update(c, next)
+		var guardErr *GuardError
+		if amount < 1000 && err != nil || amount >= 1000 && (!errors.As(err, &guardErr) || guardErr.Guard != "limit") {
+			t.Errorf("amount %d: unexpected error %v", amount, err)
+		}
+	}
+}
+
+func TestWorkerUpdateGuard(t *testing.T) {
+	adapter, worker, _ := setup(t)
+	worker.FSM.RegisterTransition(
+		GenTransition(testNew, testPay).WithGuard("positive",
+			func(c context.Context, current, next *Task[*testData]) bool { return current.Data.Amount > 0 }),
+		GenTransition(testPay, testEnd).WithGuard("limit",
+			func(c context.Context, current, next *Task[*testData]) bool { return current.Data.Amount < 1000 }),
+	)
+
+	for _, amount := range []int{0, 5000} {
+		task := createTask(t, adapter, amount)
+		acked, _ := handle(worker, task.ID) // Rejected by the guard
+		current := queryTask(t, adapter, task.ID)
+		if amount == 0 { // New has no RetryPolicy, given up
+			if current.State != "New" || !acked {
+				t.Errorf("rejected message should be settled, task: %s", util.Pretty(current))
+			}
+			continue
+		}
+		acked, _ = handle(worker, task.ID)
+		if current = queryTask(t, adapter, task.ID); current.State != "Pay" || current.Attempt != 1 || !acked {
+			t.Errorf("rejected task should be retried, task: %s", util.Pretty(current))
+		}
+	}
+}
+
+type testLedger struct {
+	ID     uint   `gorm:"primaryKey;column:id;autoIncrement"`
+	TaskID string `gorm:"column:task_id;type:char(32)"`
+	Event  string `gorm:"column:event"`
+}
+
+func (l *testLedger) TableName() string { return "ledger" }
+
+func TestAdapterCallbacks(t *testing.T) {
+	c := context.Background()
+	adapter, _, _ := setup(t)
+	if err := adapter.GetDB().AutoMigrate(&testLedger{}); err != nil {
+		t.Fatal(err)
+	}
+
+	record := func(event string) TxCallback[*testData] {
+		return func(c context.Context, tx *gorm.DB, task *Task[*testData]) error {
+			return tx.Create(&testLedger{TaskID: task.ID, Event: event}).Error
+		}
+	}
+	adapter.FSM.States["New"] = testNew.WithOnEnter(record("enter New")).WithOnExit(record("exit New"))
+	adapter.FSM.States["Pay"] = testPay.WithOnEnter(record("enter Pay")).WithOnExit(record("exit Pay"))
+	adapter.FSM.RegisterTransition(
+		GenTransition(testNew, testPay).WithOnTransition(record("New->Pay")),
+		GenTransition(testPay, testEnd).WithOnTransition(func(c context.Context, tx *gorm.DB, task *Task[*testData]) error {
+			return fmt.Errorf("ledger unavailable")
+		}),
+	)
+
+	task := createTask(t, adapter, 100)
+	update := func(state string, version uint) error {
+		next := GenTaskInstance(util.UniqueID(), task.ID, &testData{})
+		next.State, next.Version = state, version
+		return adapter.Update(c, next)
+	}
+	if err := update(testPay.GetName(), 1); err != nil {
+		t.Fatal(err)
+	}
+	var callbackErr *CallbackError
+	if err := update(testEnd.GetName(), 2); !errors.As(err, &callbackErr) || callbackErr.Callback != "on transition Pay->End" {
+		t.Errorf("the failed callback should roll back the update, got %v", err)
+	}
+
+	var events []string
+	if err := adapter.GetDB().Model(&testLedger{}).Where("task_id = ?", task.ID).Order("id").Pluck("event", &events).Error; err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"enter New", "exit New", "New->Pay", "enter Pay"}; !slices.Equal(events, expected) {
+		t.Errorf("unexpected events: %v", events)
+	}
+	if current := queryTask(t, adapter, task.ID); current.State != "Pay" {
+		t.Errorf("unexpected task: %s", util.Pretty(current))
+	}
+}
+
+func TestWorkerCallbackError(t *testing.T) {
+	adapter, worker, _ := setup(t)
+	if err := adapter.GetDB().AutoMigrate(&testLedger{}); err != nil {
+		t.Fatal(err)
+	}
+	worker.FSM.States["End"] = testEnd.WithOnEnter(func(c context.Context, tx *gorm.DB, task *Task[*testData]) error {
+		return tx.Create(&testLedger{TaskID: task.ID, Event: "enter End"}).Error
+	})
+	worker.FSM.RegisterTransition(GenTransition(testPay, testEnd).WithOnTransition(
+		func(c context.Context, tx *gorm.DB, task *Task[*testData]) error {
+			if err := tx.Create(&testLedger{TaskID: task.ID, Event: "Pay->End"}).Error; err != nil {
+				return err
+			}
+			return fmt.Errorf("ledger unavailable")
+		}),
+	)
+
+	task := createTask(t, adapter, 100)
+	var acked bool
+	for i := 0; i < 2; i++ { // New -> Pay, then Pay -> End fails
+		acked, _ = handle(worker, task.ID)
+	}
+
+	current := queryTask(t, adapter, task.ID)
+	if current.State != "Pay" || current.Attempt != 1 || !acked {
+		t.Errorf("failed callback should be retried, task: %s", util.Pretty(current))
+	}
+	var rows int64
+	if err := adapter.GetDB().Model(&testLedger{}).Where("task_id = ?", task.ID).Count(&rows).Error; err != nil || rows != 0 {
+		t.Errorf("side effects of the failed callback should be rolled back, rows: %d, %v", rows, err)
+	}
+}
+
+func TestWorkerDropsStaleMessage(t *testing.T) {
+	adapter, worker, _ := setup(t)
+	task := createTask(t, adapter, 100)
+
+	handleBody := func(body string) string {
+		if _, err := handle(worker, body); err != nil {
+			t.Fatal(err)
+		}
+		return queryTask(t, adapter, task.ID).State
+	}
+
+	for _, envelope := range []*mq.Envelope{
+		{TaskID: task.ID, FSM: "OtherFSM"},
+		{TaskID: task.ID, State: "Pay"}, // Stale
+		{TaskID: task.ID, State: "End"}, // Final
+	} {
+		if state := handleBody(envelope.Encode()); state != "New" {
+			t.Errorf("message %s should be dropped, task moved to %s", envelope.Encode(), state)
+		}
+	}
+	if state := handleBody((&mq.Envelope{TaskID: task.ID, FSM: "TestFSM", State: "New"}).Encode()); state != "Pay" {
+		t.Errorf("unexpected state: %s", state)
+	}
+	if state := handleBody(task.ID); state != "End" { // Bare task ID
+		t.Errorf("unexpected state: %s", state)
+	}
+}
+
+func TestAdapterReplayedUpdate(t *testing.T) {
+	c := context.Background()
+	adapter, worker, queue := setup(t)
+	queue.RecordPublished = true
+	task := createTask(t, adapter, 100)
+
+	requestID := util.UniqueID()
+	update := func() error {
+		next := GenTaskInstance(requestID, task.ID, &testData{Amount: 100})
+		next.State, next.Version = testPay.GetName(), task.Version
+		return adapter.Update(c, next)
+	}
+	adapter.RePublish = func(c context.Context, task *Task[*testData]) error { return fmt.Errorf("mq unavailable") }
+	if err := update(); err == nil { // Committed, but not published
+		t.Fatal("publish should fail")
+	}
+	adapter.RePublish = nil
+	if err := update(); err != nil { // Replayed by the client
+		t.Fatal(err)
+	}
+
+	published := queue.Published()
+	envelope, err := mq.DecodeEnvelope(published[len(published)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope.State != "Pay" || envelope.Version != 2 {
+		t.Errorf("replayed update should publish the current task, got %s", published[len(published)-1])
+	}
+	if acked, err := handle(worker, published[len(published)-1]); err != nil || !acked {
+		t.Errorf("the message published again should be acked, %v", err)
+	}
+	if current := queryTask(t, adapter, task.ID); current.State != "End" {
+		t.Errorf("the message published again should be handled, task: %s", util.Pretty(current))
+	}
+}